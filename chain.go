@@ -4,22 +4,45 @@ import (
 	"bytes"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/conformal/btcchain"
-	"github.com/conformal/btcscript"
+	"github.com/conformal/btcdb"
 	"github.com/conformal/btcutil"
 	"github.com/conformal/btcwire"
 	"github.com/flammit/btcdcommander"
 	"time"
 )
 
-func extendChain(net btcwire.BitcoinNet, chain *btcchain.BlockChain, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander, txs []*btcutil.Tx, blockTime *time.Time) (*btcutil.Block, error) {
-	newBlock, err := GenerateNewBlock(net, chain, prevBlock, subsidyAddress, txs, blockTime)
-	if err != nil {
-		log.Errorf("Failed to generate new block: error=%v", err)
-		return nil, err
-	}
+var (
+	ErrUnvalidatedFork = errors.New("blocks of custom networks must extend the local tip")
+)
+
+// BlockRejectedError is returned when btcd responds to submitblock with a
+// rejection reason.
+type BlockRejectedError struct {
+	Reason string
+}
+
+func (e *BlockRejectedError) Error() string {
+	return e.Reason
+}
 
-	msgBlock := newBlock.MsgBlock()
+// GeneratedBlock is a block that has been generated but not necessarily
+// added to the local chain or submitted to btcd, along with the hex
+// encoding of the serialized block that is sent with submitblock.
+type GeneratedBlock struct {
+	Block *btcutil.Block
+	Hex   string
+
+	// Report describes how the transactions of the block were assembled.
+	// It is nil for blocks that weren't assembled by GenerateBlock.
+	Report *BlockReport
+}
+
+// NewGeneratedBlock wraps msgBlock at the given height and serializes it.
+// Use it to rebuild a GeneratedBlock after mutating its MsgBlock, since
+// btcutil.Block caches the block hash.
+func NewGeneratedBlock(msgBlock *btcwire.MsgBlock, height int64) (*GeneratedBlock, error) {
 	blockHash, err := msgBlock.BlockSha()
 	if err != nil {
 		log.Errorf("Failed to calculate block hash: error=%v", err)
@@ -32,96 +55,175 @@ func extendChain(net btcwire.BitcoinNet, chain *btcchain.BlockChain, prevBlock *
 		log.Errorf("Failed to serialize block: error=%v", err)
 		return nil, err
 	}
-	blockHexString := hex.EncodeToString(blockBytes.Bytes())
-	log.Infof("Block hash (%d): %s", newBlock.Height(), blockHash.String())
+	log.Infof("Block hash (%d): %s", height, blockHash.String())
+
+	block := btcutil.NewBlock(msgBlock)
+	block.SetHeight(height)
+	return &GeneratedBlock{
+		Block: block,
+		Hex:   hex.EncodeToString(blockBytes.Bytes()),
+	}, nil
+}
 
-	// update our local chain, make sure it adds
-	err = chain.ProcessBlock(newBlock, false)
+// GenerateBlock creates a new block whose parent is prevBlock the same way
+// the ExtendChain functions do, but doesn't add it to the local chain or
+// submit it to btcd.  Use SubmitBlock to submit it later.
+func GenerateBlock(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, txs []*btcutil.Tx, opts *BlockOptions) (*GeneratedBlock, error) {
+	newBlock, report, err := GenerateNewBlockWithReport(net, chain, db, prevBlock, txs, opts)
+	if err != nil {
+		log.Errorf("Failed to generate new block: error=%v", err)
+		return nil, err
+	}
+	genBlock, err := NewGeneratedBlock(newBlock.MsgBlock(), newBlock.Height())
 	if err != nil {
-		log.Errorf("Failed to add block to chain: error=%v", err)
 		return nil, err
 	}
+	genBlock.Report = report
+	return genBlock, nil
+}
+
+// SubmitBlock adds a generated block to the local chain and submits it to
+// btcd.  A nil chain skips the local chain, which is useful when
+// submitting to a node other than the one the chain was synced from.
+func SubmitBlock(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, btcd *btcdcommander.Commander, genBlock *GeneratedBlock) error {
+	newBlock := genBlock.Block
 
-	response, jsonErr := btcd.SubmitBlock(blockHexString)
+	// update our local chain, make sure it adds
+	if chain != nil {
+		err := addBlock(net, chain, db, newBlock)
+		if err != nil {
+			log.Errorf("Failed to add block to chain: error=%v", err)
+			return err
+		}
+	}
+
+	response, jsonErr := btcd.SubmitBlock(genBlock.Hex)
 	if jsonErr != nil {
 		log.Errorf("Failed to submit block to btcd: err=%v", jsonErr)
-		return nil, errors.New(jsonErr.Message)
+		return errors.New(jsonErr.Message)
 	}
 	if response != nil {
 		log.Errorf("Failed to submit block: response is '%#v'", response)
-		return nil, errors.New(response.(string))
+		return &BlockRejectedError{Reason: fmt.Sprintf("%v", response)}
 	}
 	log.Infof("Sent Block %d", newBlock.Height())
-	return newBlock, nil
+	return nil
+}
+
+// addBlock adds block to the local chain.  Blocks of networks btcchain
+// doesn't have the rules for are inserted into db unvalidated, and only
+// when they extend the newest block since db has no side chains.
+func addBlock(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, block *btcutil.Block) error {
+	if validatesLocally(net) {
+		return chain.ProcessBlock(block, false)
+	}
+
+	newestSha, _, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+	if !block.MsgBlock().Header.PrevBlock.IsEqual(newestSha) {
+		return ErrUnvalidatedFork
+	}
+	_, err = db.InsertBlock(block)
+	return err
+}
+
+// nextBlockTime returns the current time, or a second after the timestamp
+// of prevBlock if that's later, so blocks generated faster than one per
+// second still pass the median time check.
+func nextBlockTime(prevBlock *btcutil.Block) time.Time {
+	blockTime := time.Unix(time.Now().Unix(), 0)
+	minTime := prevBlock.MsgBlock().Header.Timestamp.Add(time.Second)
+	if blockTime.Before(minTime) {
+		return minTime
+	}
+	return blockTime
+}
+
+func extendChain(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, btcd *btcdcommander.Commander, txs []*btcutil.Tx, opts *BlockOptions) (*btcutil.Block, error) {
+	genBlock, err := extendChainWithReport(net, chain, db, prevBlock, btcd, txs, opts)
+	if err != nil {
+		return nil, err
+	}
+	return genBlock.Block, nil
+}
+
+func extendChainWithReport(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, btcd *btcdcommander.Commander, txs []*btcutil.Tx, opts *BlockOptions) (*GeneratedBlock, error) {
+	genBlock, err := GenerateBlock(net, chain, db, prevBlock, txs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = SubmitBlock(net, chain, db, btcd, genBlock)
+	if err != nil {
+		return nil, err
+	}
+	return genBlock, nil
+}
+
+// ExtendChainWithOptions creates a new block that extends the main chain
+// with the given transactions and whose coinbase is created by opts.Coinbase.
+func ExtendChainWithOptions(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, btcd *btcdcommander.Commander, txs []*btcutil.Tx, opts *BlockOptions) (*btcutil.Block, error) {
+	return extendChain(net, chain, db, prevBlock, btcd, txs, opts)
 }
 
 // ExtendChainEmptyWithTime creates a new block that extends the main chain
 // but contains no transactions with a specified block time.
-func ExtendChainEmptyWithTime(net btcwire.BitcoinNet, chain *btcchain.BlockChain, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander, time *time.Time) (*btcutil.Block, error) {
-	return extendChain(net, chain, prevBlock, subsidyAddress, btcd, nil, time)
+func ExtendChainEmptyWithTime(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander, time *time.Time) (*btcutil.Block, error) {
+	return extendChain(net, chain, db, prevBlock, btcd, nil, addressBlockOptions(subsidyAddress, time))
 }
 
 // ExtendChainEmpty creates a new block that extends the main chain
 // but contains no transactions.
-func ExtendChainEmpty(net btcwire.BitcoinNet, chain *btcchain.BlockChain, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander) (*btcutil.Block, error) {
-	return extendChain(net, chain, prevBlock, subsidyAddress, btcd, nil, nil)
+func ExtendChainEmpty(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander) (*btcutil.Block, error) {
+	return extendChain(net, chain, db, prevBlock, btcd, nil, addressBlockOptions(subsidyAddress, nil))
 }
 
 // ExtendChainWithAllMempool creates a new block that extends the main
 // chain and contains all the transactions that are currently in
 // the mempool of the btcd instance.
-func ExtendChainWithAllMempool(net btcwire.BitcoinNet, chain *btcchain.BlockChain, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander) (*btcutil.Block, error) {
+func ExtendChainWithAllMempool(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander) (*btcutil.Block, error) {
 	mempoolTxs, err := RetrieveCurrentMempoolTxs(btcd)
 	if err != nil {
 		return nil, err
 	}
-	return extendChain(net, chain, prevBlock, subsidyAddress, btcd, mempoolTxs, nil)
+	return extendChain(net, chain, db, prevBlock, btcd, mempoolTxs, addressBlockOptions(subsidyAddress, nil))
 }
 
-// ExtendChainWithAllMalleatedMempool creates a new block that extends the main
-// chain and contains all the transactions that are currently in
-// the mempool of the btcd instance.
-func ExtendChainWithAllMalleatedMempool(net btcwire.BitcoinNet, chain *btcchain.BlockChain, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander) (*btcutil.Block, error) {
+// ExtendChainWithAllMempoolReport is like ExtendChainWithAllMempool but
+// also returns a report of which mempool transactions were included in the
+// block and which were skipped and why.
+func ExtendChainWithAllMempoolReport(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander) (*btcutil.Block, *BlockReport, error) {
 	mempoolTxs, err := RetrieveCurrentMempoolTxs(btcd)
-
-	malMempoolTxs := make([]*btcutil.Tx, 0)
-transactions:
-	for _, tx := range mempoolTxs {
-		log.Infof("Trying to add malleated tx: origTx.sha=%s", tx.Sha())
-		// make sure inputs aren't in mempool, is so remove
-		for _, in := range tx.MsgTx().TxIn {
-			inSha := in.PreviousOutpoint.Hash
-			for _, txCheck := range mempoolTxs {
-				if inSha.IsEqual(txCheck.Sha()) {
-					log.Infof("Transaction depends on another being malleated, skipping: tx.sha=%v, txinput.sha%v",
-						tx.Sha(), txCheck.Sha())
-					continue transactions
-				}
-			}
-		}
-
-		malTx := malleateTxAddOp0(tx)
-		log.Infof("Added malleated tx: malTx.sha=%s", malTx.Sha())
-		malMempoolTxs = append(malMempoolTxs, malTx)
+	if err != nil {
+		return nil, nil, err
 	}
+	genBlock, err := extendChainWithReport(net, chain, db, prevBlock, btcd, mempoolTxs, addressBlockOptions(subsidyAddress, nil))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return extendChain(net, chain, prevBlock, subsidyAddress, btcd, malMempoolTxs, nil)
+	return genBlock.Block, genBlock.Report, nil
 }
 
-// malleateTxAddOp0 takes a transaction and creates a new valid transaction with a
-// different transaction hash by adding OP_0 to the first input's script.
-func malleateTxAddOp0(tx *btcutil.Tx) *btcutil.Tx {
-	oldMtx := tx.MsgTx()
-	newMtx := oldMtx.Copy()
-
-	oldBytes := oldMtx.TxIn[0].SignatureScript
-	newBytes := make([]byte, len(oldBytes)+1)
-	newBytes[0] = btcscript.OP_0
-	copy(newBytes[1:], oldBytes[0:])
-
-	newMtx.TxIn[0].SignatureScript = newBytes
+// ExtendChainWithMempoolPolicy creates a new block that extends the main
+// chain and contains the transactions currently in the mempool of the
+// btcd instance that are chosen by policy, in the order it returns them.
+func ExtendChainWithMempoolPolicy(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander, policy TxSelectionPolicy) (*btcutil.Block, error) {
+	mempoolTxs, err := RetrieveCurrentMempoolTxs(btcd)
+	if err != nil {
+		return nil, err
+	}
+	opts := addressBlockOptions(subsidyAddress, nil)
+	opts.Policy = policy
+	return extendChain(net, chain, db, prevBlock, btcd, mempoolTxs, opts)
+}
 
-	return btcutil.NewTx(newMtx)
+// ExtendChainWithAllMalleatedMempool creates a new block that extends the main
+// chain and contains all the transactions that are currently in
+// the mempool of the btcd instance.  Transactions spending other
+// mempool transactions are skipped since there are no keys to re-sign them.
+func ExtendChainWithAllMalleatedMempool(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander) (*btcutil.Block, error) {
+	newBlock, _, err := ExtendChainWithMalleatedMempool(net, chain, db, prevBlock, subsidyAddress, btcd, nil, MalleateAddOp0)
+	return newBlock, err
 }
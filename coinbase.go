@@ -0,0 +1,119 @@
+package regtester
+
+import (
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// CoinbaseGenerator returns the signature script and outputs of the
+// coinbase transaction for a new block at the given height.  subsidy is
+// the block subsidy for the height and totalFees the sum of the fees paid
+// by the other transactions in the block, so a generator that claims the
+// full reward pays out subsidy + totalFees.
+type CoinbaseGenerator func(height int64, extraNonce uint64, subsidy int64, totalFees int64) ([]byte, []*btcwire.TxOut, error)
+
+// StandardCoinbaseScript returns the coinbase signature script used by
+// default: the BIP0034 block height, the extra nonce and the coinbase flags.
+func StandardCoinbaseScript(height int64, extraNonce uint64) []byte {
+	coinbaseScript := btcscript.NewScriptBuilder()
+	// BIP0034 - block version 2 needs block height at start of coinbase
+	coinbaseScript.AddInt64(height)
+	coinbaseScript.AddInt64(int64(extraNonce))
+	coinbaseScript.AddData([]byte(coinbaseFlags))
+	return coinbaseScript.Script()
+}
+
+// AddressCoinbaseGenerator pays the full block reward to address.
+func AddressCoinbaseGenerator(address btcutil.Address) CoinbaseGenerator {
+	return SplitCoinbaseGenerator(address)
+}
+
+// SplitCoinbaseGenerator splits the full block reward evenly across
+// addresses.  Any remainder goes to the first address.
+func SplitCoinbaseGenerator(addresses ...btcutil.Address) CoinbaseGenerator {
+	return func(height int64, extraNonce uint64, subsidy int64, totalFees int64) ([]byte, []*btcwire.TxOut, error) {
+		if len(addresses) == 0 {
+			return nil, nil, ErrNoCoinbaseOutputs
+		}
+
+		reward := subsidy + totalFees
+		share := reward / int64(len(addresses))
+
+		txOuts := make([]*btcwire.TxOut, len(addresses))
+		for i, address := range addresses {
+			pkScript, err := btcscript.PayToAddrScript(address)
+			if err != nil {
+				return nil, nil, err
+			}
+			txOuts[i] = &btcwire.TxOut{
+				PkScript: pkScript,
+				Value:    share,
+			}
+		}
+		txOuts[0].Value += reward - share*int64(len(addresses))
+
+		return StandardCoinbaseScript(height, extraNonce), txOuts, nil
+	}
+}
+
+// CoinbaseWithOutputs appends extraTxOuts, for example NullDataTxOut
+// commitments, to the outputs created by gen.
+func CoinbaseWithOutputs(gen CoinbaseGenerator, extraTxOuts ...*btcwire.TxOut) CoinbaseGenerator {
+	return func(height int64, extraNonce uint64, subsidy int64, totalFees int64) ([]byte, []*btcwire.TxOut, error) {
+		script, txOuts, err := gen(height, extraNonce, subsidy, totalFees)
+		if err != nil {
+			return nil, nil, err
+		}
+		return script, append(txOuts, extraTxOuts...), nil
+	}
+}
+
+// CoinbaseWithValueDelta adds delta to the value of the first output
+// created by gen.  A positive delta over-claims the block reward and a
+// negative one under-claims it.
+func CoinbaseWithValueDelta(gen CoinbaseGenerator, delta int64) CoinbaseGenerator {
+	return func(height int64, extraNonce uint64, subsidy int64, totalFees int64) ([]byte, []*btcwire.TxOut, error) {
+		script, txOuts, err := gen(height, extraNonce, subsidy, totalFees)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(txOuts) == 0 {
+			return nil, nil, ErrNoCoinbaseOutputs
+		}
+
+		// gen may return the same outputs on every call, so adjust a copy
+		adjusted := make([]*btcwire.TxOut, len(txOuts))
+		copy(adjusted, txOuts)
+		first := *txOuts[0]
+		first.Value += delta
+		adjusted[0] = &first
+		return script, adjusted, nil
+	}
+}
+
+// NullDataTxOut creates a zero value OP_RETURN output carrying data.
+func NullDataTxOut(data []byte) *btcwire.TxOut {
+	pkScript := btcscript.NewScriptBuilder()
+	pkScript.AddOp(btcscript.OP_RETURN)
+	pkScript.AddData(data)
+	return &btcwire.TxOut{
+		PkScript: pkScript.Script(),
+		Value:    0,
+	}
+}
+
+// newCoinbaseTx creates a coinbase transaction with the given signature
+// script and outputs.
+func newCoinbaseTx(coinbase []byte, txOuts []*btcwire.TxOut) *btcwire.MsgTx {
+	tx := btcwire.NewMsgTx()
+	tx.AddTxIn(&btcwire.TxIn{
+		PreviousOutpoint: btcwire.OutPoint{btcwire.ShaHash{}, btcwire.MaxTxInSequenceNum},
+		SignatureScript:  coinbase,
+		Sequence:         btcwire.MaxTxInSequenceNum,
+	})
+	for _, txOut := range txOuts {
+		tx.AddTxOut(txOut)
+	}
+	return tx
+}
@@ -0,0 +1,131 @@
+package regtester
+
+import (
+	"errors"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/flammit/btcdcommander"
+)
+
+var (
+	ErrNegativeFeeRate = errors.New("fee rate can't be negative")
+	ErrUnsignedFunding = errors.New("can't fund a transaction with unsigned inputs")
+)
+
+// DefaultFeePerKb is the fee rate in satoshi per 1000 bytes used when
+// none is specified, matching the btcd minimum relay fee.
+const DefaultFeePerKb = 10000
+
+// sigSizeSlack is the number of bytes added per input when computing the
+// fee since re-signing a transaction can grow a DER signature by a byte.
+const sigSizeSlack = 1
+
+// CalcFee returns the fee for a transaction of size bytes at feePerKb.
+func CalcFee(size int, feePerKb int64) int64 {
+	return int64(size) * feePerKb / 1000
+}
+
+// IsDust returns whether spending txOut would cost more than a third of
+// its value at feePerKb, using the same rule as btcd.
+func IsDust(txOut *btcwire.TxOut, feePerKb int64) bool {
+	if txOut.Value <= 0 {
+		return true
+	}
+	// 148 bytes is the size of a typical input spending a pay to pubkey
+	// hash output
+	totalSize := int64(txOut.SerializeSize() + 148)
+	return txOut.Value*1000/(3*totalSize) < feePerKb
+}
+
+// FundTransaction selects inputs from candidates, in order, until they
+// pay for txOuts plus the fee at feePerKb, and returns the signed
+// transaction.  Change is sent to changeAddress unless it would be dust,
+// in which case it is added to the fee.  Candidates can't be Unsigned since
+// the fee depends on the size of their signatures.
+func FundTransaction(candidates []*TxInDetails, txOuts []*btcwire.TxOut, changeAddress string, feePerKb int64) (*btcwire.MsgTx, error) {
+	if feePerKb < 0 {
+		return nil, ErrNegativeFeeRate
+	}
+
+	var outTotal int64
+	for _, txOut := range txOuts {
+		outTotal += txOut.Value
+	}
+	changeTxOut, err := PubKeyHashTxOut(changeAddress, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var inTotal int64
+	for n, candidate := range candidates {
+		if candidate.Unsigned {
+			return nil, ErrUnsignedFunding
+		}
+		if candidate.Index >= uint32(len(candidate.Tx.MsgTx().TxOut)) {
+			return nil, ErrInvalidOutpointIndex
+		}
+		inTotal += candidate.Tx.MsgTx().TxOut[candidate.Index].Value
+		if inTotal < outTotal {
+			continue
+		}
+		txIns := candidates[:n+1]
+
+		// try paying change first
+		withChange := make([]*btcwire.TxOut, len(txOuts), len(txOuts)+1)
+		copy(withChange, txOuts)
+		withChange = append(withChange, changeTxOut)
+		mtx, err := buildTransaction(txIns, withChange, 0)
+		if err != nil {
+			return nil, err
+		}
+		fee := CalcFee(mtx.SerializeSize()+sigSizeSlack*len(txIns), feePerKb)
+		changeTxOut.Value = inTotal - outTotal - fee
+		if !IsDust(changeTxOut, feePerKb) {
+			return buildTransaction(txIns, withChange, 0)
+		}
+
+		// otherwise the remainder goes to the fee
+		mtx, err = buildTransaction(txIns, txOuts, 0)
+		if err != nil {
+			return nil, err
+		}
+		fee = CalcFee(mtx.SerializeSize()+sigSizeSlack*len(txIns), feePerKb)
+		if inTotal-outTotal >= fee {
+			return mtx, nil
+		}
+	}
+
+	return nil, ErrNotEnoughFunds
+}
+
+// BuildPayment funds txOuts from candidates with FundTransaction and
+// returns the transaction along with its hex encoding without sending it
+// to btcd.
+func BuildPayment(candidates []*TxInDetails, txOuts []*btcwire.TxOut, changeAddress string, feePerKb int64) (*btcutil.Tx, string, error) {
+	mtx, err := FundTransaction(candidates, txOuts, changeAddress, feePerKb)
+	if err != nil {
+		log.Errorf("Failed to fund transaction: error=%v", err)
+		return nil, "", err
+	}
+
+	txHex, err := msgTxHex(mtx)
+	if err != nil {
+		return nil, "", err
+	}
+	return btcutil.NewTx(mtx), txHex, nil
+}
+
+// SendPayment funds txOuts from candidates with FundTransaction and sends
+// the transaction to btcd.
+func SendPayment(net btcwire.BitcoinNet, candidates []*TxInDetails, txOuts []*btcwire.TxOut, changeAddress string, feePerKb int64, btcd *btcdcommander.Commander) (*btcutil.Tx, error) {
+	tx, txHex, err := BuildPayment(candidates, txOuts, changeAddress, feePerKb)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sendTxHex(txHex, btcd)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
@@ -0,0 +1,204 @@
+package regtester
+
+import (
+	"bytes"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+const (
+	testPkWif         = "5HueCGU8rMjxEXxiPuD5BDku4MkFqeZyd4dZ1jvhTVqvbTLvyTJ"
+	testAddress       = "1GAehh7TsJAHuUAeKZcXf5CnwuGuGgyX2S"
+	testChangeAddress = "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"
+)
+
+// newTestTxOut returns a pay to pubkey hash output to address or fails t.
+func newTestTxOut(t *testing.T, address string, value int64) *btcwire.TxOut {
+	txOut, err := PubKeyHashTxOut(address, value)
+	if err != nil {
+		t.Fatalf("PubKeyHashTxOut: %v", err)
+	}
+	return txOut
+}
+
+// newTestCandidates returns spendable outputs of testPkWif with values.
+func newTestCandidates(t *testing.T, values ...int64) []*TxInDetails {
+	candidates := make([]*TxInDetails, 0, len(values))
+	for i, value := range values {
+		mtx := btcwire.NewMsgTx()
+		mtx.LockTime = uint32(i)
+		mtx.AddTxOut(newTestTxOut(t, testAddress, value))
+		candidates = append(candidates, &TxInDetails{
+			Tx:    btcutil.NewTx(mtx),
+			Index: 0,
+			PkWif: testPkWif,
+		})
+	}
+	return candidates
+}
+
+func TestCalcFee(t *testing.T) {
+	tests := []struct {
+		size     int
+		feePerKb int64
+		want     int64
+	}{
+		{0, 1000, 0},
+		{250, 0, 0},
+		{250, 1000, 250},
+		{250, DefaultFeePerKb, 2500},
+		{999, 1, 0},
+		{1000, 1, 1},
+		{1999, 1, 1},
+	}
+
+	for _, test := range tests {
+		if got := CalcFee(test.size, test.feePerKb); got != test.want {
+			t.Errorf("CalcFee(%d, %d): got %d, want %d", test.size, test.feePerKb, got, test.want)
+		}
+	}
+}
+
+func TestIsDust(t *testing.T) {
+	// a pay to pubkey hash output is 34 bytes, so spending it costs
+	// 34+148 bytes and it's dust below 3*182*feePerKb/1000
+	tests := []struct {
+		value    int64
+		feePerKb int64
+		want     bool
+	}{
+		{-1, 1000, true},
+		{0, 1000, true},
+		{0, 0, true},
+		{1, 0, false},
+		{545, 1000, true},
+		{546, 1000, false},
+		{5459, DefaultFeePerKb, true},
+		{5460, DefaultFeePerKb, false},
+	}
+
+	for _, test := range tests {
+		txOut := newTestTxOut(t, testAddress, test.value)
+		if got := IsDust(txOut, test.feePerKb); got != test.want {
+			t.Errorf("IsDust(%d, %d): got %v, want %v", test.value, test.feePerKb, got, test.want)
+		}
+	}
+}
+
+func TestFundTransaction(t *testing.T) {
+	const (
+		amount   = 50000
+		feePerKb = 1000
+	)
+
+	tests := []struct {
+		name       string
+		values     []int64
+		feePerKb   int64
+		wantInputs int
+		wantChange bool
+		wantErr    error
+	}{
+		{"change kept", []int64{100000}, feePerKb, 1, true, nil},
+		{"dust change added to fee", []int64{amount + 500}, feePerKb, 1, false, nil},
+		{"remainder below fee", []int64{amount + 100}, feePerKb, 0, false, ErrNotEnoughFunds},
+		{"insufficient funds", []int64{amount - 1}, feePerKb, 0, false, ErrNotEnoughFunds},
+		{"no candidates", []int64{}, feePerKb, 0, false, ErrNotEnoughFunds},
+		{"only needed candidates used", []int64{30000, 30000, 30000}, feePerKb, 2, true, nil},
+		{"exact amount at zero fee", []int64{amount}, 0, 1, false, nil},
+		{"negative fee rate", []int64{100000}, -1, 0, false, ErrNegativeFeeRate},
+	}
+
+	for _, test := range tests {
+		candidates := newTestCandidates(t, test.values...)
+		txOuts := []*btcwire.TxOut{newTestTxOut(t, testAddress, amount)}
+		mtx, err := FundTransaction(candidates, txOuts, testChangeAddress, test.feePerKb)
+		if err != test.wantErr {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if len(mtx.TxIn) != test.wantInputs {
+			t.Errorf("%s: got %d inputs, want %d", test.name, len(mtx.TxIn), test.wantInputs)
+			continue
+		}
+		var inTotal int64
+		for i, txIn := range mtx.TxIn {
+			if txIn.PreviousOutpoint.Hash != *candidates[i].Tx.Sha() || txIn.PreviousOutpoint.Index != 0 {
+				t.Errorf("%s: input %d spends %v, want candidate %d", test.name, i, txIn.PreviousOutpoint, i)
+			}
+			if len(txIn.SignatureScript) == 0 {
+				t.Errorf("%s: input %d isn't signed", test.name, i)
+			}
+			inTotal += test.values[i]
+		}
+
+		wantOutputs := 1
+		if test.wantChange {
+			wantOutputs = 2
+		}
+		if len(mtx.TxOut) != wantOutputs {
+			t.Errorf("%s: got %d outputs, want %d", test.name, len(mtx.TxOut), wantOutputs)
+			continue
+		}
+		if mtx.TxOut[0].Value != amount {
+			t.Errorf("%s: got payment %d, want %d", test.name, mtx.TxOut[0].Value, amount)
+		}
+		var outTotal int64
+		for _, txOut := range mtx.TxOut {
+			outTotal += txOut.Value
+		}
+		if test.wantChange {
+			change := mtx.TxOut[1]
+			if !bytes.Equal(change.PkScript, newTestTxOut(t, testChangeAddress, 0).PkScript) {
+				t.Errorf("%s: change doesn't pay the change address", test.name)
+			}
+			if IsDust(change, test.feePerKb) {
+				t.Errorf("%s: change %d is dust", test.name, change.Value)
+			}
+		}
+
+		// the fee covers the signed size, allowing for signatures that
+		// grow when the transaction is signed again
+		fee := inTotal - outTotal
+		size := mtx.SerializeSize()
+		minFee := CalcFee(size, test.feePerKb)
+		maxFee := CalcFee(size+2*sigSizeSlack*len(mtx.TxIn), test.feePerKb)
+		if !test.wantChange {
+			maxFee = inTotal - amount
+		}
+		if fee < minFee || fee > maxFee {
+			t.Errorf("%s: got fee %d for %d bytes, want between %d and %d",
+				test.name, fee, size, minFee, maxFee)
+		}
+	}
+}
+
+func TestFundTransactionInvalidCandidates(t *testing.T) {
+	unsigned := newTestCandidates(t, 100000)
+	unsigned[0].Unsigned = true
+
+	badIndex := newTestCandidates(t, 100000)
+	badIndex[0].Index = 1
+
+	tests := []struct {
+		name       string
+		candidates []*TxInDetails
+		wantErr    error
+	}{
+		{"unsigned candidate", unsigned, ErrUnsignedFunding},
+		{"invalid outpoint index", badIndex, ErrInvalidOutpointIndex},
+	}
+
+	for _, test := range tests {
+		txOuts := []*btcwire.TxOut{newTestTxOut(t, testAddress, 50000)}
+		_, err := FundTransaction(test.candidates, txOuts, testChangeAddress, 1000)
+		if err != test.wantErr {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package regtester
+
+import (
+	"errors"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math/big"
+	"time"
+)
+
+var (
+	ErrAncestorNotFound = errors.New("couldn't find ancestor block")
+)
+
+// blockFetcher looks up a block by its hash.  It matches the signature of
+// btcdb.Db.FetchBlockBySha so a database can be used directly.
+type blockFetcher func(sha *btcwire.ShaHash) (*btcutil.Block, error)
+
+// CalcNextRequiredBits calculates the difficulty bits required for a block
+// with the given timestamp that extends prevBlock.  Ancestors of prevBlock
+// are looked up in db.
+func CalcNextRequiredBits(net btcwire.BitcoinNet, db btcdb.Db, prevBlock *btcutil.Block, newBlockTime time.Time) (uint32, error) {
+	miningParams, err := ChainMiningParams(net)
+	if err != nil {
+		return 0, err
+	}
+	return calcNextRequiredBits(miningParams, db.FetchBlockBySha, prevBlock, newBlockTime)
+}
+
+// calcNextRequiredBits follows the same retargeting rules as btcchain:
+// the difficulty only changes every BlocksPerRetarget blocks, the change is
+// limited by RetargetAdjustmentFactor and capped at the proof of work limit,
+// and networks with ReduceMinDifficulty allow minimum difficulty blocks when
+// more than twice the target spacing has elapsed.
+func calcNextRequiredBits(params *MiningParams, fetchBlock blockFetcher, prevBlock *btcutil.Block, newBlockTime time.Time) (uint32, error) {
+	blocksPerRetarget := params.BlocksPerRetarget()
+	prevHeader := &prevBlock.MsgBlock().Header
+
+	if (prevBlock.Height()+1)%blocksPerRetarget != 0 {
+		if !params.ReduceMinDifficulty {
+			return prevHeader.Bits, nil
+		}
+
+		allowMinTime := prevHeader.Timestamp.Add(params.TargetSpacing * 2)
+		if newBlockTime.After(allowMinTime) {
+			return params.ChainParams.PowLimitBits, nil
+		}
+
+		// the block was mined within the desired timeframe, so use the
+		// difficulty of the last block without the minimum difficulty rule
+		return findPrevTestNetBits(params, fetchBlock, prevBlock)
+	}
+
+	firstBlock, err := ancestorBlock(fetchBlock, prevBlock, blocksPerRetarget-1)
+	if err != nil {
+		return 0, err
+	}
+
+	// limit the amount of adjustment that can occur to the previous difficulty
+	targetTimespan := int64(params.TargetTimespan / time.Second)
+	minTimespan := targetTimespan / params.RetargetAdjustmentFactor
+	maxTimespan := targetTimespan * params.RetargetAdjustmentFactor
+
+	actualTimespan := prevHeader.Timestamp.Unix() - firstBlock.MsgBlock().Header.Timestamp.Unix()
+	if actualTimespan < minTimespan {
+		actualTimespan = minTimespan
+	} else if actualTimespan > maxTimespan {
+		actualTimespan = maxTimespan
+	}
+
+	// newTarget = oldTarget * actualTimespan / targetTimespan
+	newTarget := btcchain.CompactToBig(prevHeader.Bits)
+	newTarget.Mul(newTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+
+	powLimit := params.ChainParams.PowLimit
+	if newTarget.Cmp(powLimit) > 0 {
+		newTarget.Set(powLimit)
+	}
+
+	newBits := btcchain.BigToCompact(newTarget)
+	log.Debugf("Difficulty retarget at block height %d: old bits=%08x, new bits=%08x",
+		prevBlock.Height()+1, prevHeader.Bits, newBits)
+	return newBits, nil
+}
+
+// findPrevTestNetBits returns the bits of the most recent block that did not
+// have the minimum difficulty rule applied, stopping at retarget boundaries.
+func findPrevTestNetBits(params *MiningParams, fetchBlock blockFetcher, block *btcutil.Block) (uint32, error) {
+	blocksPerRetarget := params.BlocksPerRetarget()
+	powLimitBits := params.ChainParams.PowLimitBits
+
+	for block.Height() > 0 && block.Height()%blocksPerRetarget != 0 &&
+		block.MsgBlock().Header.Bits == powLimitBits {
+		var err error
+		block, err = ancestorBlock(fetchBlock, block, 1)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return block.MsgBlock().Header.Bits, nil
+}
+
+// ancestorBlock walks back distance blocks from block.
+func ancestorBlock(fetchBlock blockFetcher, block *btcutil.Block, distance int64) (*btcutil.Block, error) {
+	for i := int64(0); i < distance; i++ {
+		if block.Height() == 0 {
+			return nil, ErrAncestorNotFound
+		}
+
+		prevBlock, err := fetchBlock(&block.MsgBlock().Header.PrevBlock)
+		if err != nil {
+			log.Errorf("Failed to fetch ancestor block: height=%d, error=%v", block.Height()-1, err)
+			return nil, err
+		}
+		prevBlock.SetHeight(block.Height() - 1)
+		block = prevBlock
+	}
+
+	return block, nil
+}
@@ -0,0 +1,249 @@
+package regtester
+
+import (
+	"errors"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+	"time"
+)
+
+var errTestBlockNotFound = errors.New("block not found")
+
+// testBlock describes a block of a chain built by newTestChain.
+type testBlock struct {
+	bits uint32
+	time int64
+}
+
+// newTestChain links blocks into a chain starting at height 0 and returns
+// them along with a blockFetcher that looks them up by hash.
+func newTestChain(t *testing.T, blocks []testBlock) ([]*btcutil.Block, blockFetcher) {
+	chain := make([]*btcutil.Block, 0, len(blocks))
+	byHash := make(map[btcwire.ShaHash]*btcwire.MsgBlock, len(blocks))
+
+	var prevHash btcwire.ShaHash
+	for i, b := range blocks {
+		msgBlock := btcwire.NewMsgBlock(&btcwire.BlockHeader{
+			Version:   2,
+			PrevBlock: prevHash,
+			Timestamp: time.Unix(b.time, 0),
+			Bits:      b.bits,
+			Nonce:     uint32(i),
+		})
+		sha, err := msgBlock.BlockSha()
+		if err != nil {
+			t.Fatalf("BlockSha: %v", err)
+		}
+		byHash[sha] = msgBlock
+		prevHash = sha
+
+		block := btcutil.NewBlock(msgBlock)
+		block.SetHeight(int64(i))
+		chain = append(chain, block)
+	}
+
+	fetchBlock := func(sha *btcwire.ShaHash) (*btcutil.Block, error) {
+		msgBlock, ok := byHash[*sha]
+		if !ok {
+			return nil, errTestBlockNotFound
+		}
+		return btcutil.NewBlock(msgBlock), nil
+	}
+	return chain, fetchBlock
+}
+
+// testMiningParams returns params with a retarget every 10 blocks and a
+// proof of work limit of 0x207fffff.
+func testMiningParams(reduceMinDifficulty bool) *MiningParams {
+	return &MiningParams{
+		Net:                      btcwire.TestNet,
+		ChainParams:              btcchain.ChainParams(btcwire.TestNet),
+		TargetTimespan:           time.Minute * 100,
+		TargetSpacing:            time.Minute * 10,
+		RetargetAdjustmentFactor: 4,
+		ReduceMinDifficulty:      reduceMinDifficulty,
+	}
+}
+
+func TestCalcNextRequiredBitsRetarget(t *testing.T) {
+	const start = 1400000000
+	targetTimespan := int64(100 * 60)
+
+	tests := []struct {
+		name     string
+		bits     uint32
+		timespan int64
+		want     uint32
+	}{
+		{"on target", 0x1d00ffff, targetTimespan, 0x1d00ffff},
+		{"twice as slow", 0x1d00ffff, targetTimespan * 2, 0x1d01fffe},
+		{"max adjustment", 0x1d00ffff, targetTimespan * 4, 0x1d03fffc},
+		{"clamped to max adjustment", 0x1d00ffff, targetTimespan * 10, 0x1d03fffc},
+		{"min adjustment", 0x1d00ffff, targetTimespan / 4, 0x1c3fffc0},
+		{"clamped to min adjustment", 0x1d00ffff, 1, 0x1c3fffc0},
+		{"clamped to pow limit", 0x207fffff, targetTimespan * 4, 0x207fffff},
+	}
+
+	params := testMiningParams(false)
+	for _, test := range tests {
+		// blocks 0 through 9, so the next block is at a retarget height
+		blocks := make([]testBlock, 10)
+		for i := range blocks {
+			blocks[i] = testBlock{test.bits, start + int64(i)}
+		}
+		blocks[9].time = start + test.timespan
+
+		chain, fetchBlock := newTestChain(t, blocks)
+		prevBlock := chain[len(chain)-1]
+		newBlockTime := time.Unix(blocks[9].time+600, 0)
+		got, err := calcNextRequiredBits(params, fetchBlock, prevBlock, newBlockTime)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got bits %08x, want %08x", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCalcNextRequiredBitsMinDifficulty(t *testing.T) {
+	const (
+		start      = 1400000000
+		normalBits = 0x1d00ffff
+		otherBits  = 0x1c7fffff
+		limitBits  = 0x207fffff
+	)
+
+	tests := []struct {
+		name       string
+		reduce     bool
+		bits       []uint32
+		timeOffset time.Duration
+		want       uint32
+	}{
+		{
+			name:       "no min difficulty rule",
+			reduce:     false,
+			bits:       []uint32{normalBits, otherBits},
+			timeOffset: time.Hour,
+			want:       otherBits,
+		},
+		{
+			name:       "late block gets min difficulty",
+			reduce:     true,
+			bits:       []uint32{normalBits, normalBits},
+			timeOffset: time.Minute*20 + time.Second,
+			want:       limitBits,
+		},
+		{
+			name:       "exactly twice spacing",
+			reduce:     true,
+			bits:       []uint32{normalBits, normalBits},
+			timeOffset: time.Minute * 20,
+			want:       normalBits,
+		},
+		{
+			name:       "walks back past min difficulty blocks",
+			reduce:     true,
+			bits:       []uint32{normalBits, otherBits, limitBits, limitBits},
+			timeOffset: time.Minute,
+			want:       otherBits,
+		},
+		{
+			name:   "stops at retarget boundary",
+			reduce: true,
+			bits: []uint32{
+				normalBits, normalBits, normalBits, normalBits, normalBits,
+				normalBits, normalBits, normalBits, normalBits, normalBits,
+				limitBits, limitBits, limitBits,
+			},
+			timeOffset: time.Minute,
+			want:       limitBits,
+		},
+		{
+			name:       "stops at genesis",
+			reduce:     true,
+			bits:       []uint32{limitBits, limitBits, limitBits},
+			timeOffset: time.Minute,
+			want:       limitBits,
+		},
+	}
+
+	for _, test := range tests {
+		blocks := make([]testBlock, len(test.bits))
+		for i, bits := range test.bits {
+			blocks[i] = testBlock{bits, start + int64(i)*600}
+		}
+
+		chain, fetchBlock := newTestChain(t, blocks)
+		prevBlock := chain[len(chain)-1]
+		newBlockTime := prevBlock.MsgBlock().Header.Timestamp.Add(test.timeOffset)
+		got, err := calcNextRequiredBits(testMiningParams(test.reduce), fetchBlock, prevBlock, newBlockTime)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got bits %08x, want %08x", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCalcNextRequiredBitsMissingAncestor(t *testing.T) {
+	blocks := make([]testBlock, 10)
+	for i := range blocks {
+		blocks[i] = testBlock{0x1d00ffff, 1400000000 + int64(i)*600}
+	}
+	chain, _ := newTestChain(t, blocks)
+	missing := func(sha *btcwire.ShaHash) (*btcutil.Block, error) {
+		return nil, errTestBlockNotFound
+	}
+
+	prevBlock := chain[len(chain)-1]
+	_, err := calcNextRequiredBits(testMiningParams(false), missing, prevBlock, time.Now())
+	if err != errTestBlockNotFound {
+		t.Errorf("got error %v, want %v", err, errTestBlockNotFound)
+	}
+}
+
+func TestAncestorBlock(t *testing.T) {
+	blocks := make([]testBlock, 5)
+	for i := range blocks {
+		blocks[i] = testBlock{0x207fffff, 1400000000 + int64(i)}
+	}
+	chain, fetchBlock := newTestChain(t, blocks)
+	tip := chain[len(chain)-1]
+
+	tests := []struct {
+		distance   int64
+		wantHeight int64
+		wantErr    error
+	}{
+		{0, 4, nil},
+		{1, 3, nil},
+		{4, 0, nil},
+		{5, 0, ErrAncestorNotFound},
+	}
+
+	for _, test := range tests {
+		ancestor, err := ancestorBlock(fetchBlock, tip, test.distance)
+		if err != test.wantErr {
+			t.Errorf("distance %d: got error %v, want %v", test.distance, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if ancestor.Height() != test.wantHeight {
+			t.Errorf("distance %d: got height %d, want %d", test.distance, ancestor.Height(), test.wantHeight)
+		}
+		wantSha, _ := chain[test.wantHeight].Sha()
+		gotSha, _ := ancestor.Sha()
+		if !gotSha.IsEqual(wantSha) {
+			t.Errorf("distance %d: got block %v, want %v", test.distance, gotSha, wantSha)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package regtester
+
+import (
+	"errors"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/flammit/btcdcommander"
+)
+
+var (
+	ErrDoubleSpendNotMined       = errors.New("conflicting transaction wasn't included in the block")
+	ErrDoubleSpendNotConflicting = errors.New("conflicting transaction is the same as the first spend")
+)
+
+// DoubleSpendResult reports the outcome of a double spend of one output.
+type DoubleSpendResult struct {
+	// MempoolTx is the spend broadcast to btcd with sendrawtransaction.
+	MempoolTx *btcutil.Tx
+
+	// BlockTx is the conflicting spend mined directly into Block.
+	BlockTx *btcutil.Tx
+	Block   *btcutil.Block
+
+	// BlockTxWon is true when Block is part of the best chain of btcd.
+	BlockTxWon bool
+
+	// MempoolTxEvicted is true when MempoolTx is no longer in the mempool
+	// of btcd.
+	MempoolTxEvicted bool
+}
+
+// MineDoubleSpend broadcasts a spend of utxo to mempoolTxOuts with
+// sendrawtransaction, then mines a block extending prevBlock containing a
+// conflicting spend of the same output to blockTxOuts and reports which
+// spend btcd kept.  It fails with ErrDoubleSpendNotConflicting if both
+// spends are the same transaction.
+func MineDoubleSpend(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander, utxo *TxInDetails, mempoolTxOuts []*btcwire.TxOut, blockTxOuts []*btcwire.TxOut) (*DoubleSpendResult, error) {
+	txIns := []*TxInDetails{utxo}
+
+	mempoolTx, mempoolTxHex, err := BuildTransaction(txIns, mempoolTxOuts)
+	if err != nil {
+		log.Errorf("Failed to build first spend: error=%v", err)
+		return nil, err
+	}
+
+	blockMtx, err := buildTransaction(txIns, blockTxOuts, 0)
+	if err != nil {
+		log.Errorf("Failed to build conflicting spend: error=%v", err)
+		return nil, err
+	}
+	blockTx := btcutil.NewTx(blockMtx)
+
+	// identical spends would just mine the first spend
+	if blockTx.Sha().IsEqual(mempoolTx.Sha()) {
+		log.Errorf("Conflicting spend is the same transaction: tx.sha=%v", blockTx.Sha())
+		return nil, ErrDoubleSpendNotConflicting
+	}
+
+	err = sendTxHex(mempoolTxHex, btcd)
+	if err != nil {
+		log.Errorf("Failed to send first spend: error=%v", err)
+		return nil, err
+	}
+	log.Infof("Sent first spend: tx.sha=%v", mempoolTx.Sha())
+
+	// check the conflicting spend made it into the block before mining it
+	genBlock, err := GenerateBlock(net, chain, db, prevBlock,
+		[]*btcutil.Tx{blockTx}, addressBlockOptions(subsidyAddress, nil))
+	if err != nil {
+		return nil, err
+	}
+	if len(genBlock.Report.Included) != 1 {
+		return nil, ErrDoubleSpendNotMined
+	}
+	err = SubmitBlock(net, chain, db, btcd, genBlock)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Mined conflicting spend: tx.sha=%v", blockTx.Sha())
+
+	result := &DoubleSpendResult{
+		MempoolTx: mempoolTx,
+		BlockTx:   blockTx,
+		Block:     genBlock.Block,
+	}
+
+	blockSha, err := genBlock.Block.Sha()
+	if err != nil {
+		return nil, err
+	}
+	bestHash, jsonErr := btcd.GetBlockHash(genBlock.Block.Height())
+	if jsonErr != nil {
+		return nil, errors.New(jsonErr.Message)
+	}
+	result.BlockTxWon = bestHash == blockSha.String()
+
+	mempoolShas, jsonErr := btcd.GetRawMempool()
+	if jsonErr != nil {
+		return nil, errors.New(jsonErr.Message)
+	}
+	result.MempoolTxEvicted = true
+	for _, sha := range mempoolShas {
+		if sha == mempoolTx.Sha().String() {
+			result.MempoolTxEvicted = false
+			break
+		}
+	}
+
+	log.Infof("Double spend result: blockTxWon=%v, mempoolTxEvicted=%v",
+		result.BlockTxWon, result.MempoolTxEvicted)
+	return result, nil
+}
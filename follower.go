@@ -0,0 +1,222 @@
+package regtester
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/btcws"
+	"github.com/flammit/btcdcommander"
+	"sync"
+)
+
+// Follower keeps a BlockChain and its db in sync with the main chain of
+// btcd using block connected and disconnected notifications.  It must be
+// the only reader of the notification channel of btcd.
+type Follower struct {
+	mtx   sync.Mutex
+	btcd  *btcdcommander.Commander
+	chain *btcchain.BlockChain
+	db    btcdb.Db
+	tip   *btcutil.Block
+
+	wallets []*Wallet
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewFollower creates a follower of btcd for chain and db, which should
+// already be synced with SyncChain or ResyncChain.
+func NewFollower(btcd *btcdcommander.Commander, chain *btcchain.BlockChain, db btcdb.Db) (*Follower, error) {
+	f := &Follower{
+		btcd:  btcd,
+		chain: chain,
+		db:    db,
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	err := f.loadTip()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// AddWallet rescans w now and whenever the tip changes, so it tracks the
+// blocks synced from btcd and those generated within Do.
+func (f *Follower) AddWallet(w *Wallet) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	err := w.Rescan(f.db)
+	if err != nil {
+		return err
+	}
+	f.wallets = append(f.wallets, w)
+	return nil
+}
+
+// Start begins handling notifications from btcd.
+func (f *Follower) Start() {
+	go f.ntfnHandler()
+}
+
+// Stop stops handling notifications and waits for the handler to exit.
+func (f *Follower) Stop() {
+	close(f.quit)
+	<-f.done
+}
+
+// Tip returns the best block known to the follower.
+func (f *Follower) Tip() *btcutil.Block {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.tip
+}
+
+// Chain returns the current BlockChain.  It's replaced when blocks are
+// disconnected, so it shouldn't be held onto.
+func (f *Follower) Chain() *btcchain.BlockChain {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.chain
+}
+
+// Do calls fn with the chain, db and tip while no notifications are being
+// handled, so blocks created by fn, such as with the ExtendChain
+// functions, build on the true tip.
+func (f *Follower) Do(fn func(chain *btcchain.BlockChain, db btcdb.Db, tip *btcutil.Block) error) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	err := fn(f.chain, f.db, f.tip)
+	if err != nil {
+		return err
+	}
+
+	// fn may have added blocks
+	return f.loadTip()
+}
+
+func (f *Follower) ntfnHandler() {
+	defer close(f.done)
+
+	ntfnChan := f.btcd.NtfnChan()
+	for {
+		select {
+		case cmd, ok := <-ntfnChan:
+			if !ok {
+				return
+			}
+
+			var err error
+			switch ntfn := cmd.(type) {
+			case *btcws.BlockConnectedNtfn:
+				err = f.blockConnected(ntfn.Hash, int64(ntfn.Height))
+			case *btcws.BlockDisconnectedNtfn:
+				err = f.blockDisconnected(ntfn.Hash, int64(ntfn.Height))
+			}
+			if err != nil {
+				log.Errorf("Failed to handle notification: ntfn=%#v, error=%v", cmd, err)
+			}
+
+		case <-f.quit:
+			return
+		}
+	}
+}
+
+// blockConnected adds the block btcd connected to the chain, falling back
+// to ResyncChain when it doesn't extend the tip.
+func (f *Follower) blockConnected(hash string, height int64) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	sha, err := btcwire.NewShaHashFromStr(hash)
+	if err != nil {
+		return err
+	}
+
+	// blocks created locally are already in the chain
+	if height <= f.tip.Height() {
+		localSha, err := f.db.FetchBlockShaByHeight(height)
+		if err == nil && localSha.IsEqual(sha) {
+			return nil
+		}
+	}
+
+	tipSha, err := f.tip.Sha()
+	if err != nil {
+		return err
+	}
+	if height == f.tip.Height()+1 {
+		block, err := downloadBlockByHash(f.btcd, hash, height)
+		if err != nil {
+			return err
+		}
+		if block.MsgBlock().Header.PrevBlock.IsEqual(tipSha) {
+			err = addBlock(f.btcd.Cfg.Net(), f.chain, f.db, block)
+			if err != nil {
+				return err
+			}
+			return f.loadTip()
+		}
+	}
+
+	log.Infof("Connected block doesn't extend tip, resyncing: hash=%s, height=%d", hash, height)
+	chain, err := ResyncChain(f.btcd, f.db)
+	if err != nil {
+		return err
+	}
+	f.chain = chain
+	return f.loadTip()
+}
+
+// blockDisconnected rewinds the chain to the parent of the block btcd
+// disconnected if it's the tip.
+func (f *Follower) blockDisconnected(hash string, height int64) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	tipSha, err := f.tip.Sha()
+	if err != nil {
+		return err
+	}
+	if tipSha.String() != hash {
+		return nil
+	}
+
+	log.Infof("Disconnecting block: hash=%s, height=%d", hash, height)
+	err = f.db.DropAfterBlockBySha(&f.tip.MsgBlock().Header.PrevBlock)
+	if err != nil {
+		return err
+	}
+	f.chain = btcchain.New(f.db, f.btcd.Cfg.Net(), nil)
+	return f.loadTip()
+}
+
+// loadTip sets the tip to the newest block in db and rescans the wallets.
+func (f *Follower) loadTip() error {
+	newestSha, newestHeight, err := f.db.NewestSha()
+	if err != nil {
+		return err
+	}
+	tip, err := f.db.FetchBlockBySha(newestSha)
+	if err != nil {
+		return err
+	}
+	tip.SetHeight(newestHeight)
+	f.tip = tip
+
+	for _, w := range f.wallets {
+		err := w.Rescan(f.db)
+		if err != nil {
+			log.Errorf("Failed to rescan wallet: error=%v", err)
+			return err
+		}
+	}
+	return nil
+}
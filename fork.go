@@ -0,0 +1,184 @@
+package regtester
+
+import (
+	"errors"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/flammit/btcdcommander"
+)
+
+var (
+	ErrInvalidReleaseIndex = errors.New("invalid fork block index to release")
+)
+
+// Fork builds a branch of blocks on top of an arbitrary ancestor block and
+// holds them back until they are released to btcd.  This allows competing
+// branches to be prepared and a reorganization to be triggered on demand.
+// The ancestor must be part of the main chain held in the database.
+type Fork struct {
+	net      btcwire.BitcoinNet
+	chain    *btcchain.BlockChain
+	db       btcdb.Db
+	btcd     *btcdcommander.Commander
+	ancestor *btcutil.Block
+
+	// Blocks holds the generated blocks of the fork in chain order.
+	Blocks []*btcutil.Block
+}
+
+// ReorgResult describes the best chain of btcd before and after fork blocks
+// were released.
+type ReorgResult struct {
+	OldBestHash   string
+	OldBestHeight int64
+	NewBestHash   string
+	NewBestHeight int64
+
+	// Reorganized is true when the old best block is no longer part of
+	// the best chain of btcd.
+	Reorganized bool
+
+	// ForkIsBest is true when the tip of the fork is the new best block.
+	ForkIsBest bool
+}
+
+// NewFork creates a fork that builds on ancestor.
+func NewFork(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, btcd *btcdcommander.Commander, ancestor *btcutil.Block) *Fork {
+	return &Fork{
+		net:      net,
+		chain:    chain,
+		db:       db,
+		btcd:     btcd,
+		ancestor: ancestor,
+		Blocks:   make([]*btcutil.Block, 0),
+	}
+}
+
+// Tip returns the last block of the fork, or the ancestor if no blocks
+// have been generated yet.
+func (f *Fork) Tip() *btcutil.Block {
+	if len(f.Blocks) == 0 {
+		return f.ancestor
+	}
+	return f.Blocks[len(f.Blocks)-1]
+}
+
+// Extend generates n empty blocks on the tip of the fork paying their
+// subsidy to subsidyAddress.  The blocks are held back until released.
+func (f *Fork) Extend(n int, subsidyAddress btcutil.Address) ([]*btcutil.Block, error) {
+	newBlocks := make([]*btcutil.Block, 0, n)
+	for i := 0; i < n; i++ {
+		newBlock, err := f.ExtendWithOptions(nil, addressBlockOptions(subsidyAddress, nil))
+		if err != nil {
+			return nil, err
+		}
+		newBlocks = append(newBlocks, newBlock)
+	}
+	return newBlocks, nil
+}
+
+// ExtendWithOptions generates a block containing txs on the tip of the fork
+// and holds it back until released.  When opts.BlockTime isn't set the
+// block is timestamped a second after its parent if needed, so blocks can
+// be generated faster than one per second.
+func (f *Fork) ExtendWithOptions(txs []*btcutil.Tx, opts *BlockOptions) (*btcutil.Block, error) {
+	if opts == nil {
+		return nil, ErrNoCoinbaseGenerator
+	}
+
+	forkOpts := *opts
+	forkOpts.Pending = make([]*btcutil.Block, 0, len(f.Blocks)+len(opts.Pending))
+	forkOpts.Pending = append(forkOpts.Pending, f.Blocks...)
+	forkOpts.Pending = append(forkOpts.Pending, opts.Pending...)
+
+	prevBlock := f.Tip()
+	if forkOpts.BlockTime == nil {
+		blockTime := nextBlockTime(prevBlock)
+		forkOpts.BlockTime = &blockTime
+	}
+
+	newBlock, err := GenerateNewBlockWithOptions(f.net, f.chain, f.db, prevBlock, txs, &forkOpts)
+	if err != nil {
+		log.Errorf("Failed to generate fork block: error=%v", err)
+		return nil, err
+	}
+	log.Infof("Generated fork block %d", newBlock.Height())
+
+	f.Blocks = append(f.Blocks, newBlock)
+	return newBlock, nil
+}
+
+// ReleaseAll submits all blocks of the fork to btcd in chain order.
+func (f *Fork) ReleaseAll() (*ReorgResult, error) {
+	order := make([]int, len(f.Blocks))
+	for i := range order {
+		order[i] = i
+	}
+	return f.Release(order)
+}
+
+// Release submits the fork blocks at the given indexes to the local chain
+// and btcd in the order given, then reports whether btcd reorganized.
+// Blocks released before their parent are held by btcd as orphans.
+func (f *Fork) Release(order []int) (*ReorgResult, error) {
+	for _, i := range order {
+		if i < 0 || i >= len(f.Blocks) {
+			return nil, ErrInvalidReleaseIndex
+		}
+	}
+
+	oldBest, jsonErr := f.btcd.GetBestBlock()
+	if jsonErr != nil {
+		return nil, errors.New(jsonErr.Message)
+	}
+
+	for _, i := range order {
+		block := f.Blocks[i]
+		genBlock, err := NewGeneratedBlock(block.MsgBlock(), block.Height())
+		if err != nil {
+			return nil, err
+		}
+		err = SubmitBlock(f.net, f.chain, f.db, f.btcd, genBlock)
+		if err != nil {
+			log.Errorf("Failed to release fork block: index=%d, error=%v", i, err)
+			return nil, err
+		}
+	}
+
+	newBest, jsonErr := f.btcd.GetBestBlock()
+	if jsonErr != nil {
+		return nil, errors.New(jsonErr.Message)
+	}
+
+	result := &ReorgResult{
+		OldBestHash:   oldBest.Hash,
+		OldBestHeight: int64(oldBest.Height),
+		NewBestHash:   newBest.Hash,
+		NewBestHeight: int64(newBest.Height),
+	}
+
+	// the old best block is still in the best chain if btcd has the same
+	// block at its height
+	if result.NewBestHeight >= result.OldBestHeight {
+		oldHeightHash, jsonErr := f.btcd.GetBlockHash(result.OldBestHeight)
+		if jsonErr != nil {
+			return nil, errors.New(jsonErr.Message)
+		}
+		result.Reorganized = oldHeightHash != result.OldBestHash
+	} else {
+		result.Reorganized = true
+	}
+
+	tipSha, err := f.Tip().Sha()
+	if err != nil {
+		return nil, err
+	}
+	result.ForkIsBest = tipSha.String() == result.NewBestHash
+
+	log.Infof("Released fork: oldBest=%s (%d), newBest=%s (%d), reorganized=%v",
+		result.OldBestHash, result.OldBestHeight, result.NewBestHash,
+		result.NewBestHeight, result.Reorganized)
+	return result, nil
+}
@@ -0,0 +1,252 @@
+package regtester
+
+import (
+	"context"
+	"errors"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/flammit/btcdcommander"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidBlockAccepted = errors.New("invalid block was accepted by btcd")
+	ErrInvalidBlockNeedsTx  = errors.New("invalid block needs a non-coinbase transaction")
+)
+
+// InvalidBlock describes a way of breaking a generated block and the
+// rejection reason btcd is expected to respond with when it is submitted.
+type InvalidBlock struct {
+	Name string
+
+	// Coinbase wraps the coinbase generator of the block when set.
+	Coinbase func(gen CoinbaseGenerator) CoinbaseGenerator
+
+	// Mutate breaks the generated block when set.  Mutations that change
+	// the transactions or header must call FinalizeBlock afterwards unless
+	// the merkle root or proof of work is meant to be invalid.
+	Mutate func(params *MiningParams, prevBlock *btcutil.Block, msgBlock *btcwire.MsgBlock) error
+
+	// Reject is a substring of the rejection reason expected from btcd.
+	Reject string
+}
+
+var (
+	// BadMerkleRoot has a merkle root that doesn't match its transactions.
+	BadMerkleRoot = &InvalidBlock{
+		Name: "bad merkle root",
+		Mutate: func(params *MiningParams, prevBlock *btcutil.Block, msgBlock *btcwire.MsgBlock) error {
+			msgBlock.Header.MerkleRoot[0] ^= 0xff
+			_, err := CalculateNewBlockHash(btcutil.NewBlock(msgBlock))
+			return err
+		},
+		Reject: "merkle root is invalid",
+	}
+
+	// CoinbaseOverpay claims one satoshi more than the subsidy and fees.
+	CoinbaseOverpay = &InvalidBlock{
+		Name: "coinbase overpays subsidy",
+		Coinbase: func(gen CoinbaseGenerator) CoinbaseGenerator {
+			return CoinbaseWithValueDelta(gen, 1)
+		},
+		Reject: "which is more than expected value",
+	}
+
+	// DuplicateTx contains its first non-coinbase transaction twice.
+	DuplicateTx = &InvalidBlock{
+		Name: "duplicate transactions",
+		Mutate: func(params *MiningParams, prevBlock *btcutil.Block, msgBlock *btcwire.MsgBlock) error {
+			if len(msgBlock.Transactions) < 2 {
+				return ErrInvalidBlockNeedsTx
+			}
+			msgBlock.AddTransaction(msgBlock.Transactions[1])
+			return FinalizeBlock(msgBlock)
+		},
+		Reject: "duplicate transaction",
+	}
+
+	// MissingHeight has a coinbase script that doesn't start with the
+	// BIP0034 block height.  btcd only enforces this once version 2
+	// blocks are the majority of recent blocks.
+	MissingHeight = &InvalidBlock{
+		Name: "missing BIP0034 height",
+		Coinbase: func(gen CoinbaseGenerator) CoinbaseGenerator {
+			return func(height int64, extraNonce uint64, subsidy int64, totalFees int64) ([]byte, []*btcwire.TxOut, error) {
+				_, txOuts, err := gen(height, extraNonce, subsidy, totalFees)
+				if err != nil {
+					return nil, nil, err
+				}
+				coinbaseScript := btcscript.NewScriptBuilder()
+				coinbaseScript.AddData([]byte(coinbaseFlags))
+				coinbaseScript.AddInt64(int64(extraNonce))
+				return coinbaseScript.Script(), txOuts, nil
+			}
+		},
+		Reject: "serialized block height",
+	}
+
+	// FutureTimestamp is timestamped three hours from now, beyond the two
+	// hours btcd allows.
+	FutureTimestamp = &InvalidBlock{
+		Name: "timestamp too far in the future",
+		Mutate: func(params *MiningParams, prevBlock *btcutil.Block, msgBlock *btcwire.MsgBlock) error {
+			msgBlock.Header.Timestamp = time.Unix(time.Now().Add(3*time.Hour).Unix(), 0)
+			return FinalizeBlock(msgBlock)
+		},
+		Reject: "too far in the future",
+	}
+
+	// PastTimestamp is timestamped at the genesis block time, which is
+	// never after the median time of the previous blocks.
+	PastTimestamp = &InvalidBlock{
+		Name: "timestamp below median time past",
+		Mutate: func(params *MiningParams, prevBlock *btcutil.Block, msgBlock *btcwire.MsgBlock) error {
+			msgBlock.Header.Timestamp = params.ChainParams.GenesisBlock.Header.Timestamp
+			return FinalizeBlock(msgBlock)
+		},
+		Reject: "is not after expected",
+	}
+
+	// OversizedBlock carries a transaction with an output script larger
+	// than the maximum block size.
+	OversizedBlock = &InvalidBlock{
+		Name: "oversized block",
+		Mutate: func(params *MiningParams, prevBlock *btcutil.Block, msgBlock *btcwire.MsgBlock) error {
+			mtx := btcwire.NewMsgTx()
+			mtx.AddTxIn(&btcwire.TxIn{
+				PreviousOutpoint: btcwire.OutPoint{btcwire.ShaHash{0x01}, 0},
+				SignatureScript:  nil,
+				Sequence:         btcwire.MaxTxInSequenceNum,
+			})
+			mtx.AddTxOut(&btcwire.TxOut{
+				PkScript: make([]byte, btcwire.MaxBlockPayload),
+				Value:    0,
+			})
+			msgBlock.AddTransaction(mtx)
+			return FinalizeBlock(msgBlock)
+		},
+		Reject: "serialized block is too big",
+	}
+
+	// BadProofOfWork has a hash above its target.
+	BadProofOfWork = &InvalidBlock{
+		Name: "bad proof of work",
+		Mutate: func(params *MiningParams, prevBlock *btcutil.Block, msgBlock *btcwire.MsgBlock) error {
+			target := btcchain.CompactToBig(msgBlock.Header.Bits)
+			for {
+				msgBlock.Header.Nonce++
+				hash, err := msgBlock.BlockSha()
+				if err != nil {
+					return err
+				}
+				if btcchain.ShaHashToBig(&hash).Cmp(target) > 0 {
+					return nil
+				}
+			}
+		},
+		Reject: "is higher than expected max",
+	}
+
+	// DoubleSpend contains its first non-coinbase transaction along with
+	// a malleated copy, so both spend the same outputs with valid scripts.
+	DoubleSpend = &InvalidBlock{
+		Name: "double spend within block",
+		Mutate: func(params *MiningParams, prevBlock *btcutil.Block, msgBlock *btcwire.MsgBlock) error {
+			if len(msgBlock.Transactions) < 2 {
+				return ErrInvalidBlockNeedsTx
+			}
+			malTx, err := MalleateTx(btcutil.NewTx(msgBlock.Transactions[1]), MalleateAddOp0)
+			if err != nil {
+				return err
+			}
+			msgBlock.AddTransaction(malTx.MsgTx())
+			return FinalizeBlock(msgBlock)
+		},
+		Reject: "double spend",
+	}
+
+	// InvalidBlocks is the catalog of all the invalid block kinds.  The
+	// DuplicateTx and DoubleSpend kinds need at least one transaction.
+	InvalidBlocks = []*InvalidBlock{
+		BadMerkleRoot,
+		CoinbaseOverpay,
+		DuplicateTx,
+		MissingHeight,
+		FutureTimestamp,
+		PastTimestamp,
+		OversizedBlock,
+		BadProofOfWork,
+		DoubleSpend,
+	}
+)
+
+// FinalizeBlock updates the merkle root of msgBlock to match its
+// transactions and solves its proof of work again.
+func FinalizeBlock(msgBlock *btcwire.MsgBlock) error {
+	updateMerkleRoot(msgBlock)
+	_, _, err := solveBlock(context.Background(), btcutil.NewBlock(msgBlock), nil, nil)
+	return err
+}
+
+// GenerateInvalidBlock generates a block extending prevBlock that is broken
+// as described by invalid.  It isn't added to the local chain or submitted.
+func GenerateInvalidBlock(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, txs []*btcutil.Tx, invalid *InvalidBlock) (*GeneratedBlock, error) {
+	opts := addressBlockOptions(subsidyAddress, nil)
+	if invalid.Coinbase != nil {
+		opts.Coinbase = invalid.Coinbase(opts.Coinbase)
+	}
+
+	newBlock, err := GenerateNewBlockWithOptions(net, chain, db, prevBlock, txs, opts)
+	if err != nil {
+		log.Errorf("Failed to generate new block: error=%v", err)
+		return nil, err
+	}
+
+	msgBlock := newBlock.MsgBlock()
+	if invalid.Mutate != nil {
+		miningParams, err := ChainMiningParams(net)
+		if err != nil {
+			return nil, err
+		}
+		err = invalid.Mutate(miningParams, prevBlock, msgBlock)
+		if err != nil {
+			log.Errorf("Failed to mutate block: invalid=%s, error=%v", invalid.Name, err)
+			return nil, err
+		}
+	}
+	return NewGeneratedBlock(msgBlock, newBlock.Height())
+}
+
+// SubmitInvalidBlock generates a block extending prevBlock that is broken
+// as described by invalid, submits it to btcd and checks that it was
+// rejected for the expected reason.  A rejection for any other reason is
+// returned as a *BlockRejectedError.  The local chain isn't updated.
+func SubmitInvalidBlock(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander, txs []*btcutil.Tx, invalid *InvalidBlock) error {
+	genBlock, err := GenerateInvalidBlock(net, chain, db, prevBlock, subsidyAddress, txs, invalid)
+	if err != nil {
+		return err
+	}
+
+	err = SubmitBlock(net, nil, db, btcd, genBlock)
+	if err == nil {
+		log.Errorf("Invalid block was accepted: invalid=%s", invalid.Name)
+		return ErrInvalidBlockAccepted
+	}
+
+	rejectErr, ok := err.(*BlockRejectedError)
+	if !ok {
+		return err
+	}
+	if !strings.Contains(rejectErr.Reason, invalid.Reject) {
+		log.Errorf("Invalid block rejected for unexpected reason: invalid=%s, expected=%q, reason=%q",
+			invalid.Name, invalid.Reject, rejectErr.Reason)
+		return rejectErr
+	}
+
+	log.Infof("Invalid block rejected as expected: invalid=%s, reason=%q", invalid.Name, rejectErr.Reason)
+	return nil
+}
@@ -0,0 +1,60 @@
+package regtester
+
+import (
+	"github.com/conformal/btcec"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// PubKeyFromWif returns the serialized public key of the private key
+// encoded in pkWif, compressed if the WIF string says so.
+func PubKeyFromWif(pkWif string) ([]byte, error) {
+	privateKey, compressed, err := decodeKeyPair(pkWif)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey := (*btcec.PublicKey)(&privateKey.PublicKey)
+	if compressed {
+		return pubKey.SerializeCompressed(), nil
+	}
+	return pubKey.SerializeUncompressed(), nil
+}
+
+// AddressFromWif returns the pay-to-pubkey-hash address of the private key
+// encoded in pkWif.
+func AddressFromWif(net btcwire.BitcoinNet, pkWif string) (btcutil.Address, error) {
+	serializedPubKey, err := PubKeyFromWif(pkWif)
+	if err != nil {
+		return nil, err
+	}
+
+	return btcutil.NewAddressPubKeyHash(btcutil.Hash160(serializedPubKey), net)
+}
+
+// keyring maps the pay-to-pubkey-hash scripts of a set of private keys to
+// the keys encoded as WIF strings.
+type keyring map[string]string
+
+func newKeyring(net btcwire.BitcoinNet, pkWifs []string) (keyring, error) {
+	keys := make(keyring, len(pkWifs))
+	for _, pkWif := range pkWifs {
+		address, err := AddressFromWif(net, pkWif)
+		if err != nil {
+			return nil, err
+		}
+		pkScript, err := btcscript.PayToAddrScript(address)
+		if err != nil {
+			return nil, err
+		}
+		keys[string(pkScript)] = pkWif
+	}
+	return keys, nil
+}
+
+// wif returns the key that can sign for pkScript.
+func (k keyring) wif(pkScript []byte) (string, bool) {
+	pkWif, ok := k[string(pkScript)]
+	return pkWif, ok
+}
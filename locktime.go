@@ -0,0 +1,64 @@
+package regtester
+
+import (
+	"errors"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/flammit/btcdcommander"
+	"time"
+)
+
+var (
+	ErrTxNotFinal = errors.New("transaction isn't final at the lock time")
+)
+
+// LockTimeThreshold is the lock time below which it's interpreted as a
+// block height rather than a unix time.
+const LockTimeThreshold = 500000000
+
+// lockTimeBlockTime returns the timestamp for a block extending prevBlock
+// that can include a transaction with lockTime.  Time locks are judged by
+// the timestamp of the including block, so it's stamped after the lock.
+func lockTimeBlockTime(lockTime uint32, prevBlock *btcutil.Block) time.Time {
+	blockTime := nextBlockTime(prevBlock)
+	if lockTime >= LockTimeThreshold {
+		lockEnd := time.Unix(int64(lockTime)+1, 0)
+		if lockEnd.After(blockTime) {
+			return lockEnd
+		}
+	}
+	return blockTime
+}
+
+// ExtendChainUntilLockTime creates empty blocks extending prevBlock until
+// a transaction with a height lockTime can be included in the next block,
+// then mines txs in a block that can include a transaction with lockTime
+// and returns that block.  A time locked transaction is only final in a
+// block stamped after the lock, and later blocks can be stamped before
+// their parent, so it has to be mined in that block rather than a later
+// one.  btcd rejects blocks more than two hours in the future, so time
+// locks should be close to now.  It fails with ErrTxNotFinal if any of txs
+// isn't final in the new block.
+func ExtendChainUntilLockTime(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander, lockTime uint32, txs []*btcutil.Tx) (*btcutil.Block, error) {
+	block := prevBlock
+	for lockTime < LockTimeThreshold && block.Height()+1 <= int64(lockTime) {
+		blockTime := nextBlockTime(block)
+		newBlock, err := ExtendChainEmptyWithTime(net, chain, db, block, subsidyAddress, btcd, &blockTime)
+		if err != nil {
+			log.Errorf("Failed to extend chain to lock time: error=%v", err)
+			return nil, err
+		}
+		block = newBlock
+	}
+
+	blockTime := lockTimeBlockTime(lockTime, block)
+	for _, tx := range txs {
+		if !btcchain.IsFinalizedTransaction(tx, block.Height()+1, blockTime) {
+			log.Errorf("Transaction isn't final at lock time: tx.sha=%v, lockTime=%d", tx.Sha(), tx.MsgTx().LockTime)
+			return nil, ErrTxNotFinal
+		}
+	}
+	return extendChain(net, chain, db, block, btcd, txs, addressBlockOptions(subsidyAddress, &blockTime))
+}
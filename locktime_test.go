@@ -0,0 +1,42 @@
+package regtester
+
+import (
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+	"time"
+)
+
+func TestLockTimeBlockTime(t *testing.T) {
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name      string
+		prevTime  int64
+		lockTime  uint32
+		wantAfter int64
+		wantTime  int64
+	}{
+		{"height lock uses next block time", now - 600, 100, now, 0},
+		{"height lock after future parent", now + 600, 100, 0, now + 601},
+		{"past time lock uses next block time", now - 600, uint32(now - 300), now, 0},
+		{"future time lock", now - 600, uint32(now + 600), 0, now + 601},
+		{"time lock before future parent", now + 600, uint32(now + 300), 0, now + 601},
+	}
+
+	for _, test := range tests {
+		prevBlock := btcutil.NewBlock(btcwire.NewMsgBlock(&btcwire.BlockHeader{
+			Timestamp: time.Unix(test.prevTime, 0),
+		}))
+		got := lockTimeBlockTime(test.lockTime, prevBlock).Unix()
+		if test.wantTime != 0 && got != test.wantTime {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.wantTime)
+		}
+		if test.wantTime == 0 && got < test.wantAfter {
+			t.Errorf("%s: got %d, want at least %d", test.name, got, test.wantAfter)
+		}
+		if test.lockTime >= LockTimeThreshold && got <= int64(test.lockTime) {
+			t.Errorf("%s: block time %d isn't after lock time %d", test.name, got, test.lockTime)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package regtester
+
+import (
+	"errors"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcec"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/flammit/btcdcommander"
+	"math/big"
+)
+
+var (
+	ErrMalformedScript     = errors.New("malformed signature script")
+	ErrNoSignatureInScript = errors.New("no signature found in signature script")
+	ErrInvalidInputIndex   = errors.New("invalid transaction input index")
+	ErrMaxPushEncoding     = errors.New("data push already uses OP_PUSHDATA4")
+	ErrNoPushInScript      = errors.New("no data push found in signature script")
+)
+
+// MalleationStrategy rewrites a signature script so the hash of the
+// transaction changes while the script still satisfies the output it spends.
+type MalleationStrategy func(sigScript []byte) ([]byte, error)
+
+var (
+	// MalleateAddOp0 pushes an extra empty value before the script.
+	MalleateAddOp0 MalleationStrategy = func(sigScript []byte) ([]byte, error) {
+		return append([]byte{btcscript.OP_0}, sigScript...), nil
+	}
+
+	// MalleateAddNop inserts OP_NOP before the script.
+	MalleateAddNop MalleationStrategy = func(sigScript []byte) ([]byte, error) {
+		return append([]byte{btcscript.OP_NOP}, sigScript...), nil
+	}
+
+	// MalleatePushData re-encodes the first data push with OP_PUSHDATA1,
+	// OP_PUSHDATA2 or OP_PUSHDATA4, whichever is larger than its current
+	// encoding.  It fails if the push already uses OP_PUSHDATA4 or the
+	// script has no data push.
+	MalleatePushData MalleationStrategy = func(sigScript []byte) ([]byte, error) {
+		ops, err := parseScriptOps(sigScript)
+		if err != nil {
+			return nil, err
+		}
+		for i, op := range ops {
+			if op.data == nil {
+				continue
+			}
+			if op.raw[0] == btcscript.OP_PUSHDATA4 {
+				return nil, ErrMaxPushEncoding
+			}
+			ops[i].raw = nonMinimalPush(op.raw[0], op.data)
+			return joinScriptOps(ops), nil
+		}
+		return nil, ErrNoPushInScript
+	}
+
+	// MalleateFlipS replaces the S value of the first signature with
+	// N - S, turning a low-S signature into a high-S one and vice versa.
+	MalleateFlipS MalleationStrategy = func(sigScript []byte) ([]byte, error) {
+		return mapSignature(sigScript, func(r, s []byte) ([]byte, []byte) {
+			flipped := new(big.Int).Sub(btcec.S256().N, new(big.Int).SetBytes(s))
+			return r, derInt(flipped.Bytes())
+		})
+	}
+
+	// MalleateDERPadding pads the R value of the first signature with an
+	// extra leading zero byte.
+	MalleateDERPadding MalleationStrategy = func(sigScript []byte) ([]byte, error) {
+		return mapSignature(sigScript, func(r, s []byte) ([]byte, []byte) {
+			return append([]byte{0x00}, r...), s
+		})
+	}
+)
+
+// MalleationReport maps the hash of each original transaction to the hash
+// of its malleated copy.
+type MalleationReport map[btcwire.ShaHash]btcwire.ShaHash
+
+// MalleateTx returns a copy of tx whose signature scripts at the given
+// input indexes are rewritten by strategy.  With no indexes only the first
+// input is malleated.
+func MalleateTx(tx *btcutil.Tx, strategy MalleationStrategy, inputs ...int) (*btcutil.Tx, error) {
+	newMtx := tx.MsgTx().Copy()
+	if len(inputs) == 0 {
+		inputs = []int{0}
+	}
+
+	for _, i := range inputs {
+		if i < 0 || i >= len(newMtx.TxIn) {
+			return nil, ErrInvalidInputIndex
+		}
+		sigScript, err := strategy(newMtx.TxIn[i].SignatureScript)
+		if err != nil {
+			log.Errorf("Failed to malleate input: tx.sha=%v, input=%d, error=%v", tx.Sha(), i, err)
+			return nil, err
+		}
+		newMtx.TxIn[i].SignatureScript = sigScript
+	}
+
+	return btcutil.NewTx(newMtx), nil
+}
+
+// ExtendChainWithMalleatedMempool creates a new block that extends the main
+// chain and contains a malleated copy of each transaction in the mempool of
+// the btcd instance.  Transactions that only spend confirmed outputs are
+// malleated by strategy at the given input indexes.  Transactions spending
+// other mempool transactions are rewritten to spend the malleated copies
+// and re-signed with the matching key from pkWifs, so whole dependency
+// chains are malleated; they are skipped when no key matches.
+func ExtendChainWithMalleatedMempool(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, prevBlock *btcutil.Block, subsidyAddress btcutil.Address, btcd *btcdcommander.Commander, pkWifs []string, strategy MalleationStrategy, inputs ...int) (*btcutil.Block, MalleationReport, error) {
+	mempoolTxs, err := RetrieveCurrentMempoolTxs(btcd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	malMempoolTxs, report, err := malleateTxChains(net, chain, mempoolTxs, pkWifs, strategy, inputs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newBlock, err := extendChain(net, chain, db, prevBlock, btcd, malMempoolTxs, addressBlockOptions(subsidyAddress, nil))
+	if err != nil {
+		return nil, nil, err
+	}
+	return newBlock, report, nil
+}
+
+// malleateTxChains malleates txs in dependency order, rewriting and
+// re-signing the transactions that spend other transactions in txs.
+func malleateTxChains(net btcwire.BitcoinNet, chain *btcchain.BlockChain, txs []*btcutil.Tx, pkWifs []string, strategy MalleationStrategy, inputs []int) ([]*btcutil.Tx, MalleationReport, error) {
+	keys, err := newKeyring(net, pkWifs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	candidates := make([]*BlockTx, len(txs))
+	for i, tx := range txs {
+		candidates[i] = &BlockTx{Tx: tx}
+	}
+	ordered, err := orderBlockTxs(candidates)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	batch := make(map[btcwire.ShaHash]bool, len(txs))
+	for _, tx := range txs {
+		batch[*tx.Sha()] = true
+	}
+
+	report := make(MalleationReport)
+	malleated := make(map[btcwire.ShaHash]*btcutil.Tx, len(txs))
+	malTxs := make([]*btcutil.Tx, 0, len(txs))
+	for _, candidate := range ordered {
+		tx := candidate.Tx
+		log.Infof("Trying to add malleated tx: origTx.sha=%s", tx.Sha())
+
+		dependent := false
+		for _, in := range tx.MsgTx().TxIn {
+			if batch[in.PreviousOutpoint.Hash] {
+				dependent = true
+				break
+			}
+		}
+
+		var malTx *btcutil.Tx
+		if dependent {
+			malTx, err = resignDependentTx(chain, tx, malleated, keys)
+		} else {
+			malTx, err = MalleateTx(tx, strategy, inputs...)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if malTx == nil {
+			continue
+		}
+
+		log.Infof("Added malleated tx: malTx.sha=%s", malTx.Sha())
+		report[*tx.Sha()] = *malTx.Sha()
+		malleated[*tx.Sha()] = malTx
+		malTxs = append(malTxs, malTx)
+	}
+
+	return malTxs, report, nil
+}
+
+// resignDependentTx returns a copy of tx spending the malleated copies of
+// its parents, signed with keys.  It returns nil when a parent wasn't
+// malleated or no key can sign one of the inputs.
+func resignDependentTx(chain *btcchain.BlockChain, tx *btcutil.Tx, malleated map[btcwire.ShaHash]*btcutil.Tx, keys keyring) (*btcutil.Tx, error) {
+	txStore, err := chain.FetchTransactionStore(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	newMtx := tx.MsgTx().Copy()
+	subscripts := make([][]byte, len(newMtx.TxIn))
+	for i, txIn := range newMtx.TxIn {
+		var prevMtx *btcwire.MsgTx
+		if malParent, ok := malleated[txIn.PreviousOutpoint.Hash]; ok {
+			prevMtx = malParent.MsgTx()
+			txIn.PreviousOutpoint.Hash = *malParent.Sha()
+		} else if txData, ok := txStore[txIn.PreviousOutpoint.Hash]; ok && txData.Err == nil {
+			prevMtx = txData.Tx.MsgTx()
+		} else {
+			log.Infof("Transaction depends on one that wasn't malleated, skipping: tx.sha=%v, txinput.sha=%v",
+				tx.Sha(), txIn.PreviousOutpoint.Hash)
+			return nil, nil
+		}
+
+		if int(txIn.PreviousOutpoint.Index) >= len(prevMtx.TxOut) {
+			return nil, ErrInvalidOutpointIndex
+		}
+		subscripts[i] = prevMtx.TxOut[txIn.PreviousOutpoint.Index].PkScript
+	}
+
+	// every signature commits to all of the outpoints, so sign again only
+	// once all of them have been rewritten
+	for i, subscript := range subscripts {
+		pkWif, ok := keys.wif(subscript)
+		if !ok {
+			log.Infof("No key to re-sign transaction, skipping: tx.sha=%v, input=%d", tx.Sha(), i)
+			return nil, nil
+		}
+		err := signInput(newMtx, i, subscript, pkWif, btcscript.SigHashAll)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return btcutil.NewTx(newMtx), nil
+}
+
+// scriptOp is a single parsed opcode.  raw holds the opcode and any pushed
+// data exactly as encoded and data the pushed data for push opcodes.
+type scriptOp struct {
+	raw  []byte
+	data []byte
+}
+
+// parseScriptOps splits script into its opcodes.
+func parseScriptOps(script []byte) ([]scriptOp, error) {
+	ops := make([]scriptOp, 0)
+	for i := 0; i < len(script); {
+		opcode := script[i]
+
+		var dataStart, dataLen int
+		switch {
+		case opcode >= btcscript.OP_DATA_1 && opcode <= btcscript.OP_DATA_75:
+			dataStart, dataLen = i+1, int(opcode)
+		case opcode == btcscript.OP_PUSHDATA1:
+			if i+2 > len(script) {
+				return nil, ErrMalformedScript
+			}
+			dataStart, dataLen = i+2, int(script[i+1])
+		case opcode == btcscript.OP_PUSHDATA2:
+			if i+3 > len(script) {
+				return nil, ErrMalformedScript
+			}
+			dataStart, dataLen = i+3, int(script[i+1])|int(script[i+2])<<8
+		case opcode == btcscript.OP_PUSHDATA4:
+			if i+5 > len(script) {
+				return nil, ErrMalformedScript
+			}
+			dataStart = i + 5
+			dataLen = int(script[i+1]) | int(script[i+2])<<8 |
+				int(script[i+3])<<16 | int(script[i+4])<<24
+		default:
+			ops = append(ops, scriptOp{raw: script[i : i+1]})
+			i++
+			continue
+		}
+
+		dataEnd := dataStart + dataLen
+		if dataLen < 0 || dataEnd > len(script) {
+			return nil, ErrMalformedScript
+		}
+		ops = append(ops, scriptOp{
+			raw:  script[i:dataEnd],
+			data: script[dataStart:dataEnd],
+		})
+		i = dataEnd
+	}
+	return ops, nil
+}
+
+// joinScriptOps serializes ops back into a script.
+func joinScriptOps(ops []scriptOp) []byte {
+	script := make([]byte, 0)
+	for _, op := range ops {
+		script = append(script, op.raw...)
+	}
+	return script
+}
+
+// canonicalPush encodes data with the smallest push opcode.
+func canonicalPush(data []byte) []byte {
+	builder := btcscript.NewScriptBuilder()
+	builder.AddData(data)
+	return builder.Script()
+}
+
+// nonMinimalPush encodes data with a larger push opcode than opcode.
+func nonMinimalPush(opcode byte, data []byte) []byte {
+	n := len(data)
+	switch {
+	case opcode < btcscript.OP_PUSHDATA1 && n <= 0xff:
+		return append([]byte{btcscript.OP_PUSHDATA1, byte(n)}, data...)
+	case opcode < btcscript.OP_PUSHDATA2 && n <= 0xffff:
+		return append([]byte{btcscript.OP_PUSHDATA2, byte(n), byte(n >> 8)}, data...)
+	default:
+		return append([]byte{btcscript.OP_PUSHDATA4, byte(n), byte(n >> 8),
+			byte(n >> 16), byte(n >> 24)}, data...)
+	}
+}
+
+// mapSignature rewrites the R and S values of the first DER signature
+// pushed by sigScript with f.
+func mapSignature(sigScript []byte, f func(r, s []byte) ([]byte, []byte)) ([]byte, error) {
+	ops, err := parseScriptOps(sigScript)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		r, s, hashType, ok := parseDERSignature(op.data)
+		if !ok {
+			continue
+		}
+		r, s = f(r, s)
+		sig := append(encodeDERSignature(r, s), hashType)
+		ops[i].raw = canonicalPush(sig)
+		return joinScriptOps(ops), nil
+	}
+	return nil, ErrNoSignatureInScript
+}
+
+// parseDERSignature splits a DER encoded signature followed by a hash type
+// byte into its R and S values.
+func parseDERSignature(sig []byte) ([]byte, []byte, byte, bool) {
+	if len(sig) < 9 || sig[0] != 0x30 || int(sig[1]) != len(sig)-3 || sig[2] != 0x02 {
+		return nil, nil, 0, false
+	}
+	rLen := int(sig[3])
+	if 4+rLen+2 > len(sig)-1 || sig[4+rLen] != 0x02 {
+		return nil, nil, 0, false
+	}
+	sLen := int(sig[5+rLen])
+	if 6+rLen+sLen != len(sig)-1 {
+		return nil, nil, 0, false
+	}
+	r := sig[4 : 4+rLen]
+	s := sig[6+rLen : 6+rLen+sLen]
+	return r, s, sig[len(sig)-1], true
+}
+
+// encodeDERSignature DER encodes the R and S values as given.
+func encodeDERSignature(r, s []byte) []byte {
+	der := []byte{0x30, byte(4 + len(r) + len(s)), 0x02, byte(len(r))}
+	der = append(der, r...)
+	der = append(der, 0x02, byte(len(s)))
+	return append(der, s...)
+}
+
+// derInt returns the minimal DER integer encoding of the big endian b.
+func derInt(b []byte) []byte {
+	if len(b) == 0 || b[0]&0x80 != 0 {
+		return append([]byte{0x00}, b...)
+	}
+	return b
+}
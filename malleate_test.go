@@ -0,0 +1,268 @@
+package regtester
+
+import (
+	"bytes"
+	"github.com/conformal/btcec"
+	"github.com/conformal/btcscript"
+	"math/big"
+	"testing"
+)
+
+func TestParseScriptOps(t *testing.T) {
+	data := bytes.Repeat([]byte{0xaa}, 3)
+
+	tests := []struct {
+		name     string
+		script   []byte
+		wantData [][]byte
+		wantErr  error
+	}{
+		{"empty", []byte{}, [][]byte{}, nil},
+		{"opcodes only", []byte{btcscript.OP_0, btcscript.OP_DUP}, [][]byte{nil, nil}, nil},
+		{"direct push", append([]byte{0x03}, data...), [][]byte{data}, nil},
+		{
+			name:     "pushdata1",
+			script:   append([]byte{btcscript.OP_PUSHDATA1, 0x03}, data...),
+			wantData: [][]byte{data},
+		},
+		{
+			name:     "pushdata2",
+			script:   append([]byte{btcscript.OP_PUSHDATA2, 0x03, 0x00}, data...),
+			wantData: [][]byte{data},
+		},
+		{
+			name:     "pushdata4",
+			script:   append([]byte{btcscript.OP_PUSHDATA4, 0x03, 0x00, 0x00, 0x00}, data...),
+			wantData: [][]byte{data},
+		},
+		{
+			name:     "push then opcode",
+			script:   append(append([]byte{0x03}, data...), btcscript.OP_CHECKSIG),
+			wantData: [][]byte{data, nil},
+		},
+		{"direct push truncated", []byte{0x03, 0xaa, 0xaa}, nil, ErrMalformedScript},
+		{"pushdata1 missing length", []byte{btcscript.OP_PUSHDATA1}, nil, ErrMalformedScript},
+		{"pushdata1 truncated", []byte{btcscript.OP_PUSHDATA1, 0x02, 0xaa}, nil, ErrMalformedScript},
+		{"pushdata2 missing length", []byte{btcscript.OP_PUSHDATA2, 0x01}, nil, ErrMalformedScript},
+		{"pushdata4 missing length", []byte{btcscript.OP_PUSHDATA4, 0x01, 0x00, 0x00}, nil, ErrMalformedScript},
+		{"pushdata4 huge length", []byte{btcscript.OP_PUSHDATA4, 0xff, 0xff, 0xff, 0x7f}, nil, ErrMalformedScript},
+	}
+
+	for _, test := range tests {
+		ops, err := parseScriptOps(test.script)
+		if err != test.wantErr {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(ops) != len(test.wantData) {
+			t.Errorf("%s: got %d ops, want %d", test.name, len(ops), len(test.wantData))
+			continue
+		}
+		for i, op := range ops {
+			if !bytes.Equal(op.data, test.wantData[i]) || (op.data == nil) != (test.wantData[i] == nil) {
+				t.Errorf("%s: op %d: got data %x, want %x", test.name, i, op.data, test.wantData[i])
+			}
+		}
+		if got := joinScriptOps(ops); !bytes.Equal(got, test.script) {
+			t.Errorf("%s: joined script %x, want %x", test.name, got, test.script)
+		}
+	}
+}
+
+func TestDERSignatureRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		r, s     []byte
+		hashType byte
+	}{
+		{"32 byte values", bytes.Repeat([]byte{0x11}, 32), bytes.Repeat([]byte{0x22}, 32), btcscript.SigHashAll},
+		{"padded r", append([]byte{0x00}, bytes.Repeat([]byte{0x81}, 32)...), bytes.Repeat([]byte{0x22}, 32), btcscript.SigHashAll},
+		{"padded s", bytes.Repeat([]byte{0x11}, 32), append([]byte{0x00}, bytes.Repeat([]byte{0x81}, 32)...), btcscript.SigHashNone},
+		{"short values", []byte{0x01}, []byte{0x02, 0x03}, btcscript.SigHashSingle | btcscript.SigHashAnyOneCanPay},
+	}
+
+	for _, test := range tests {
+		sig := append(encodeDERSignature(test.r, test.s), test.hashType)
+		r, s, hashType, ok := parseDERSignature(sig)
+		if !ok {
+			t.Errorf("%s: failed to parse %x", test.name, sig)
+			continue
+		}
+		if !bytes.Equal(r, test.r) || !bytes.Equal(s, test.s) || hashType != test.hashType {
+			t.Errorf("%s: got r=%x s=%x hashType=%x, want r=%x s=%x hashType=%x",
+				test.name, r, s, hashType, test.r, test.s, test.hashType)
+		}
+		if got := append(encodeDERSignature(r, s), hashType); !bytes.Equal(got, sig) {
+			t.Errorf("%s: re-encoded %x, want %x", test.name, got, sig)
+		}
+	}
+}
+
+func TestParseDERSignatureMalformed(t *testing.T) {
+	valid := append(encodeDERSignature([]byte{0x01, 0x02}, []byte{0x03, 0x04}), btcscript.SigHashAll)
+
+	corrupt := func(i int, b byte) []byte {
+		sig := append([]byte{}, valid...)
+		sig[i] = b
+		return sig
+	}
+
+	tests := []struct {
+		name string
+		sig  []byte
+	}{
+		{"empty", []byte{}},
+		{"too short", valid[:8]},
+		{"missing hash type", valid[:len(valid)-1]},
+		{"trailing byte", append(append([]byte{}, valid...), 0x00)},
+		{"not a sequence", corrupt(0, 0x31)},
+		{"wrong total length", corrupt(1, valid[1]+1)},
+		{"r not an integer", corrupt(2, 0x03)},
+		{"r length too long", corrupt(3, 0x05)},
+		{"s not an integer", corrupt(6, 0x03)},
+		{"s length too short", corrupt(7, 0x01)},
+	}
+
+	for _, test := range tests {
+		if _, _, _, ok := parseDERSignature(test.sig); ok {
+			t.Errorf("%s: parsed malformed signature %x", test.name, test.sig)
+		}
+	}
+}
+
+// testSigScript returns a pay to pubkey hash style signature script
+// pushing a signature with r and s followed by a compressed public key.
+func testSigScript(r, s []byte) []byte {
+	sig := append(encodeDERSignature(derInt(r), derInt(s)), btcscript.SigHashAll)
+	pubKey := append([]byte{0x02}, bytes.Repeat([]byte{0x33}, 32)...)
+	builder := btcscript.NewScriptBuilder()
+	builder.AddData(sig).AddData(pubKey)
+	return builder.Script()
+}
+
+func TestMalleateFlipS(t *testing.T) {
+	n := btcec.S256().N
+	halfN := new(big.Int).Rsh(n, 1)
+	r := bytes.Repeat([]byte{0x11}, 32)
+
+	tests := []struct {
+		name string
+		s    *big.Int
+	}{
+		{"low s", big.NewInt(0x1234)},
+		{"half order", halfN},
+		{"high s", new(big.Int).Add(halfN, big.NewInt(1))},
+		{"max s", new(big.Int).Sub(n, big.NewInt(1))},
+	}
+
+	for _, test := range tests {
+		sigScript := testSigScript(r, test.s.Bytes())
+		flipped, err := MalleateFlipS(sigScript)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		ops, err := parseScriptOps(flipped)
+		if err != nil || len(ops) != 2 {
+			t.Errorf("%s: malformed malleated script %x", test.name, flipped)
+			continue
+		}
+		gotR, gotS, hashType, ok := parseDERSignature(ops[0].data)
+		if !ok {
+			t.Errorf("%s: malformed malleated signature %x", test.name, ops[0].data)
+			continue
+		}
+		wantS := new(big.Int).Sub(n, test.s)
+		if !bytes.Equal(gotS, derInt(wantS.Bytes())) {
+			t.Errorf("%s: got s=%x, want %x", test.name, gotS, derInt(wantS.Bytes()))
+		}
+		if !bytes.Equal(gotR, derInt(r)) || hashType != btcscript.SigHashAll {
+			t.Errorf("%s: r or hash type changed: r=%x hashType=%x", test.name, gotR, hashType)
+		}
+		lowS := test.s.Cmp(halfN) <= 0
+		if flippedLowS := wantS.Cmp(halfN) <= 0; lowS == flippedLowS {
+			t.Errorf("%s: low s=%v unchanged by flip", test.name, lowS)
+		}
+		if !bytes.Equal(ops[1].raw, sigScript[len(sigScript)-34:]) {
+			t.Errorf("%s: public key push changed", test.name)
+		}
+
+		restored, err := MalleateFlipS(flipped)
+		if err != nil {
+			t.Errorf("%s: unexpected error flipping back: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(restored, sigScript) {
+			t.Errorf("%s: flipping twice got %x, want %x", test.name, restored, sigScript)
+		}
+	}
+}
+
+func TestMalleateFlipSNoSignature(t *testing.T) {
+	sigScript := []byte{btcscript.OP_0, 0x02, 0x01, 0x02}
+	if _, err := MalleateFlipS(sigScript); err != ErrNoSignatureInScript {
+		t.Errorf("got error %v, want %v", err, ErrNoSignatureInScript)
+	}
+}
+
+func TestMalleatePushData(t *testing.T) {
+	data := bytes.Repeat([]byte{0xaa}, 3)
+
+	tests := []struct {
+		name    string
+		script  []byte
+		want    []byte
+		wantErr error
+	}{
+		{
+			name:   "direct push",
+			script: append([]byte{0x03}, data...),
+			want:   append([]byte{btcscript.OP_PUSHDATA1, 0x03}, data...),
+		},
+		{
+			name:   "pushdata1",
+			script: append([]byte{btcscript.OP_PUSHDATA1, 0x03}, data...),
+			want:   append([]byte{btcscript.OP_PUSHDATA2, 0x03, 0x00}, data...),
+		},
+		{
+			name:   "pushdata2",
+			script: append([]byte{btcscript.OP_PUSHDATA2, 0x03, 0x00}, data...),
+			want:   append([]byte{btcscript.OP_PUSHDATA4, 0x03, 0x00, 0x00, 0x00}, data...),
+		},
+		{
+			name:    "pushdata4",
+			script:  append([]byte{btcscript.OP_PUSHDATA4, 0x03, 0x00, 0x00, 0x00}, data...),
+			wantErr: ErrMaxPushEncoding,
+		},
+		{
+			name:   "only first push changed",
+			script: append([]byte{btcscript.OP_0, 0x01, 0xbb, 0x03}, data...),
+			want:   append([]byte{btcscript.OP_0, btcscript.OP_PUSHDATA1, 0x01, 0xbb, 0x03}, data...),
+		},
+		{
+			name:    "no push",
+			script:  []byte{btcscript.OP_0, btcscript.OP_NOP},
+			wantErr: ErrNoPushInScript,
+		},
+		{
+			name:    "malformed",
+			script:  []byte{0x03, 0xaa},
+			wantErr: ErrMalformedScript,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := MalleatePushData(test.script)
+		if err != test.wantErr {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.wantErr)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %x, want %x", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package regtester
+
+import (
+	"errors"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/flammit/btcdcommander"
+)
+
+var (
+	ErrImmatureCoinbase = errors.New("coinbase can't be spent until it matures")
+)
+
+// CoinbaseMatureHeight returns the height of the first block that can
+// spend the coinbase of the block at coinbaseHeight.
+func CoinbaseMatureHeight(net btcwire.BitcoinNet, coinbaseHeight int64) (int64, error) {
+	miningParams, err := ChainMiningParams(net)
+	if err != nil {
+		return 0, err
+	}
+	return coinbaseHeight + miningParams.CoinbaseMaturity, nil
+}
+
+// CheckCoinbaseMaturity returns ErrImmatureCoinbase if the coinbase of the
+// block at coinbaseHeight can't be spent in the block after the newest
+// one in db.
+func CheckCoinbaseMaturity(net btcwire.BitcoinNet, db btcdb.Db, coinbaseHeight int64) error {
+	matureHeight, err := CoinbaseMatureHeight(net, coinbaseHeight)
+	if err != nil {
+		return err
+	}
+	_, newestHeight, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+	if newestHeight+1 < matureHeight {
+		return ErrImmatureCoinbase
+	}
+	return nil
+}
+
+// MatureCoinbases returns the coinbase transactions in the main chain that
+// can be spent in the block after the one at height.  The genesis coinbase
+// is never spendable so it isn't included.
+func MatureCoinbases(net btcwire.BitcoinNet, db btcdb.Db, height int64) ([]*btcutil.Tx, error) {
+	miningParams, err := ChainMiningParams(net)
+	if err != nil {
+		return nil, err
+	}
+
+	coinbases := make([]*btcutil.Tx, 0)
+	for coinbaseHeight := int64(1); coinbaseHeight+miningParams.CoinbaseMaturity <= height+1; coinbaseHeight++ {
+		tx, err := RetrieveCoinbaseTransaction(db, coinbaseHeight)
+		if err != nil {
+			return nil, err
+		}
+		coinbases = append(coinbases, tx)
+	}
+	return coinbases, nil
+}
+
+// SpendMatureCoinbaseTransaction is like SpendCoinbaseTransaction but first
+// extends the main chain with empty blocks paying to subsidyAddress until
+// the coinbase at height has matured.
+func SpendMatureCoinbaseTransaction(net btcwire.BitcoinNet, chain *btcchain.BlockChain, db btcdb.Db, btcd *btcdcommander.Commander, height int64, subsidyPrivateKeyWif string, pubKeyHash string, subsidyAddress btcutil.Address) (*btcutil.Tx, error) {
+	matureHeight, err := CoinbaseMatureHeight(net, height)
+	if err != nil {
+		return nil, err
+	}
+
+	newestSha, newestHeight, err := db.NewestSha()
+	if err != nil {
+		return nil, err
+	}
+	prevBlock, err := db.FetchBlockBySha(newestSha)
+	if err != nil {
+		log.Errorf("Failed to fetch newest block: error=%v", err)
+		return nil, err
+	}
+	prevBlock.SetHeight(newestHeight)
+
+	for prevBlock.Height()+1 < matureHeight {
+		blockTime := nextBlockTime(prevBlock)
+		prevBlock, err = ExtendChainEmptyWithTime(net, chain, db, prevBlock, subsidyAddress, btcd, &blockTime)
+		if err != nil {
+			log.Errorf("Failed to extend chain until coinbase matures: error=%v", err)
+			return nil, err
+		}
+	}
+
+	return SpendCoinbaseTransaction(net, db, btcd, height, subsidyPrivateKeyWif, pubKeyHash)
+}
@@ -1,12 +1,13 @@
 package regtester
 
 import (
+	"context"
 	"errors"
 	"github.com/conformal/btcchain"
+	"github.com/conformal/btcdb"
 	"github.com/conformal/btcscript"
 	"github.com/conformal/btcutil"
 	"github.com/conformal/btcwire"
-	"math"
 	"math/big"
 	"time"
 )
@@ -21,8 +22,21 @@ var (
 	bitcoindMinTarget = new(big.Int).Sub(new(big.Int).Lsh(bigOne, 240), bigOne)
 )
 
+const (
+	// blockOverheadSize is the size of the block header plus the largest
+	// encoding of the transaction count.
+	blockOverheadSize = 80 + 9
+
+	// extraNonceReserveSize leaves room in the block for the coinbase to
+	// grow as the extra nonce is rolled.
+	extraNonceReserveSize = 8
+)
+
 var (
 	ErrValidBlockHashNotFound = errors.New("couldn't find valid block hash")
+	ErrNoCoinbaseGenerator    = errors.New("no coinbase generator given")
+	ErrNoCoinbaseOutputs      = errors.New("coinbase has no outputs")
+	ErrTxDependencyCycle      = errors.New("block transactions have a dependency cycle")
 )
 
 // GenerateCoinbaseTx creates a new coinbase transaction with a single
@@ -30,50 +44,75 @@ var (
 // NOTE: the value is set to zero and must be set after the block
 // contents is finalized.
 func GenerateCoinbaseTx(coinbase []byte, address btcutil.Address) (*btcwire.MsgTx, error) {
-	tx := btcwire.NewMsgTx()
-	tx.AddTxIn(&btcwire.TxIn{
-		PreviousOutpoint: btcwire.OutPoint{btcwire.ShaHash{}, btcwire.MaxTxInSequenceNum},
-		SignatureScript:  coinbase,
-		Sequence:         btcwire.MaxTxInSequenceNum,
-	})
 	pkScript, err := btcscript.PayToAddrScript(address)
 	if err != nil {
 		return nil, err
 	}
-	tx.AddTxOut(&btcwire.TxOut{
+	txOut := &btcwire.TxOut{
 		PkScript: pkScript,
 		Value:    0,
-	})
-	return tx, nil
+	}
+	return newCoinbaseTx(coinbase, []*btcwire.TxOut{txOut}), nil
 }
 
-// TODO: add priority
-type blockTx struct {
+// BlockTx is a candidate transaction for a new block along with the
+// details selection policies use to choose between candidates.
+type BlockTx struct {
 	Tx             *btcutil.Tx
 	TxInputAmounts []int64
+
+	// Fee is the total input value minus the total output value.
+	Fee int64
+
+	// Size is the serialized size of the transaction in bytes.
+	Size int
+
+	// SigOps is the number of signature operations in the transaction.
+	SigOps int
+
+	// Priority is the sum of each input value multiplied by its number of
+	// confirmations at the new block height, divided by Size.  Inputs from
+	// unconfirmed transactions contribute nothing.
+	Priority float64
+
+	// parents holds the hashes of the other candidates it spends from.
+	parents []btcwire.ShaHash
 }
 
-func calcBlockTx(chain *btcchain.BlockChain, txs []*btcutil.Tx) ([]*blockTx, error) {
-	if txs == nil {
-		return []*blockTx{}, nil
+// FeePerKb returns the fee of the transaction per 1000 bytes.
+func (btx *BlockTx) FeePerKb() int64 {
+	if btx.Size == 0 {
+		return 0
 	}
+	return btx.Fee * 1000 / int64(btx.Size)
+}
 
-	blockTxs := make([]*blockTx, 0)
+// calcBlockTx resolves the inputs of txs from the chain or the other
+// transactions in txs and calculates the details used to assemble a block
+// at height.  Transactions whose inputs can't be resolved are returned as
+// skipped.
+func calcBlockTx(chain *btcchain.BlockChain, txs []*btcutil.Tx, height int64) ([]*BlockTx, []*SkippedTx, error) {
+	blockTxs := make([]*BlockTx, 0, len(txs))
+	report := &BlockReport{}
 
 transaction:
 	for _, tx := range txs {
 		txStore, err := chain.FetchTransactionStore(tx)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		mtx := tx.MsgTx()
-		blockTx := &blockTx{
+		blockTx := &BlockTx{
 			Tx:             tx,
 			TxInputAmounts: make([]int64, len(mtx.TxIn)),
+			Size:           mtx.SerializeSize(),
+			SigOps:         btcchain.CountSigOps(tx),
 		}
+		var inputValueAge float64
 		for txInIndex, txIn := range mtx.TxIn {
 			var inMsgTx *btcwire.MsgTx
+			var inputAge int64
 
 			txData, ok := txStore[txIn.PreviousOutpoint.Hash]
 			if !ok || txData.Err != nil {
@@ -83,127 +122,328 @@ transaction:
 						inMsgTx = t.MsgTx()
 					}
 				}
+				if inMsgTx != nil {
+					blockTx.parents = append(blockTx.parents, txIn.PreviousOutpoint.Hash)
+				}
 			} else {
 				inMsgTx = txData.Tx.MsgTx()
+				inputAge = height - txData.BlockHeight
 			}
 
 			if inMsgTx == nil {
-				log.Infof("Skipping transaction because no input available")
+				report.skip(tx, SkipMissingInput)
 				continue transaction
 			}
 
 			if int(txIn.PreviousOutpoint.Index) >= len(inMsgTx.TxOut) {
-				return nil, ErrInvalidOutpointIndex
+				report.skip(tx, SkipInvalidOutpoint)
+				continue transaction
 			}
 
 			inMsgTxOut := inMsgTx.TxOut[txIn.PreviousOutpoint.Index]
 			blockTx.TxInputAmounts[txInIndex] += inMsgTxOut.Value
+			inputValueAge += float64(inMsgTxOut.Value * inputAge)
 		}
+
+		var inputValue int64
+		for _, amount := range blockTx.TxInputAmounts {
+			inputValue += amount
+		}
+		var outputValue int64
+		for _, txOut := range mtx.TxOut {
+			outputValue += txOut.Value
+		}
+		blockTx.Fee = inputValue - outputValue
+		if blockTx.Fee < 0 {
+			report.skip(tx, SkipNegativeFee)
+			continue
+		}
+		if blockTx.Size > 0 {
+			blockTx.Priority = inputValueAge / float64(blockTx.Size)
+		}
+
 		blockTxs = append(blockTxs, blockTx)
 	}
 
-	return blockTxs, nil
+	return blockTxs, report.Skipped, nil
+}
+
+// orderBlockTxs sorts blockTxs so every transaction comes after the
+// transactions in blockTxs it spends from, otherwise keeping their order.
+// It fails with ErrTxDependencyCycle if the dependencies form a cycle.
+func orderBlockTxs(blockTxs []*BlockTx) ([]*BlockTx, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	index := make(map[btcwire.ShaHash]int, len(blockTxs))
+	for i, blockTx := range blockTxs {
+		if _, ok := index[*blockTx.Tx.Sha()]; !ok {
+			index[*blockTx.Tx.Sha()] = i
+		}
+	}
+
+	state := make([]int, len(blockTxs))
+	ordered := make([]*BlockTx, 0, len(blockTxs))
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			log.Errorf("Transaction dependency cycle: tx.sha=%v", blockTxs[i].Tx.Sha())
+			return ErrTxDependencyCycle
+		}
+
+		state[i] = visiting
+		for _, txIn := range blockTxs[i].Tx.MsgTx().TxIn {
+			parent, ok := index[txIn.PreviousOutpoint.Hash]
+			if !ok {
+				continue
+			}
+			err := visit(parent)
+			if err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+
+		ordered = append(ordered, blockTxs[i])
+		return nil
+	}
+
+	for i := range blockTxs {
+		err := visit(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// BlockOptions holds the settings used by GenerateNewBlockWithOptions.
+type BlockOptions struct {
+	// BlockTime overrides the timestamp of the new block when set.
+	BlockTime *time.Time
+
+	// Coinbase generates the coinbase script and outputs of the new block.
+	// It is called more than once: to measure the coinbase size and again
+	// with a new extra nonce whenever the header nonce space is exhausted.
+	Coinbase CoinbaseGenerator
+
+	// Policy selects and orders the transactions included in the block.
+	// Nil includes every transaction whose inputs are available.  The
+	// order is adjusted so transactions always follow their parents.
+	Policy TxSelectionPolicy
+
+	// Solver controls the proof of work search.  Nil searches serially.
+	Solver *SolverOptions
+
+	// Context cancels the proof of work search when set.
+	Context context.Context
+
+	// Pending holds blocks that were generated but aren't in the database
+	// yet, such as the earlier blocks of a held back fork.  They are
+	// searched before the database when looking up ancestors of prevBlock.
+	Pending []*btcutil.Block
+}
+
+// fetchBlock returns a blockFetcher that searches opts.Pending before db.
+func (opts *BlockOptions) fetchBlock(db btcdb.Db) blockFetcher {
+	if len(opts.Pending) == 0 {
+		return db.FetchBlockBySha
+	}
+	return func(sha *btcwire.ShaHash) (*btcutil.Block, error) {
+		for _, block := range opts.Pending {
+			blockSha, err := block.Sha()
+			if err != nil {
+				return nil, err
+			}
+			if blockSha.IsEqual(sha) {
+				return block, nil
+			}
+		}
+		return db.FetchBlockBySha(sha)
+	}
+}
+
+// addressBlockOptions returns the options for a block paying its subsidy
+// to subsidyAddress.
+func addressBlockOptions(subsidyAddress btcutil.Address, blockTime *time.Time) *BlockOptions {
+	return &BlockOptions{
+		BlockTime: blockTime,
+		Coinbase:  AddressCoinbaseGenerator(subsidyAddress),
+	}
 }
 
 // GenerateNewBlock creates a new block whose parent is prevBlock
 // and which potentially contains all of the transactions in txs.
-// The subsidy will go to the subsidyAddress.
+// The subsidy will go to the subsidyAddress.  The difficulty is
+// retargeted using the ancestors of prevBlock found in db.
 func GenerateNewBlock(
 	net btcwire.BitcoinNet,
 	chain *btcchain.BlockChain,
+	db btcdb.Db,
 	prevBlock *btcutil.Block,
 	subsidyAddress btcutil.Address,
 	txs []*btcutil.Tx,
 	blockTime *time.Time,
 ) (*btcutil.Block, error) {
-	// TODO: allow a coinbase tx generator function given total fees
-	// to set coinbase vouts
-	miningParams := ChainMiningParams(net)
+	opts := addressBlockOptions(subsidyAddress, blockTime)
+	return GenerateNewBlockWithOptions(net, chain, db, prevBlock, txs, opts)
+}
+
+// GenerateNewBlockWithOptions creates a new block whose parent is prevBlock
+// and which potentially contains all of the transactions in txs.  The
+// coinbase transaction is created by opts.Coinbase, so nil opts returns
+// ErrNoCoinbaseGenerator.
+func GenerateNewBlockWithOptions(
+	net btcwire.BitcoinNet,
+	chain *btcchain.BlockChain,
+	db btcdb.Db,
+	prevBlock *btcutil.Block,
+	txs []*btcutil.Tx,
+	opts *BlockOptions,
+) (*btcutil.Block, error) {
+	newBlock, _, err := GenerateNewBlockWithReport(net, chain, db, prevBlock, txs, opts)
+	return newBlock, err
+}
+
+// GenerateNewBlockWithReport is like GenerateNewBlockWithOptions but also
+// returns a report of which transactions were included in the block, with
+// their fees, which were skipped and why, and the work done solving it.
+func GenerateNewBlockWithReport(
+	net btcwire.BitcoinNet,
+	chain *btcchain.BlockChain,
+	db btcdb.Db,
+	prevBlock *btcutil.Block,
+	txs []*btcutil.Tx,
+	opts *BlockOptions,
+) (*btcutil.Block, *BlockReport, error) {
+	if opts == nil || opts.Coinbase == nil {
+		return nil, nil, ErrNoCoinbaseGenerator
+	}
+	miningParams, err := ChainMiningParams(net)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// setup block header
 	prevHash, err := prevBlock.Sha()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// TODO: calculate correctly based on retargeting
-	nextDifficulty := prevBlock.MsgBlock().Header.Bits
-
-	newBlockHeader := btcwire.NewBlockHeader(prevHash, &btcwire.ShaHash{}, nextDifficulty, 0)
-	if blockTime != nil {
-		newBlockHeader.Timestamp = *blockTime
+	newBlockHeader := btcwire.NewBlockHeader(prevHash, &btcwire.ShaHash{}, 0, 0)
+	if opts.BlockTime != nil {
+		newBlockHeader.Timestamp = *opts.BlockTime
+	}
+	newBlockHeader.Bits, err = calcNextRequiredBits(miningParams, opts.fetchBlock(db),
+		prevBlock, newBlockHeader.Timestamp)
+	if err != nil {
+		return nil, nil, err
 	}
 	newMsgBlock := btcwire.NewMsgBlock(newBlockHeader)
 	newBlockHeight := prevBlock.Height() + 1
-	newExtraNonce := 0
+	var newExtraNonce uint64
+	subsidy := miningParams.BlockSubsidy(newBlockHeight)
 
-	// add coinbase transaction
-	coinbaseScript := btcscript.NewScriptBuilder()
-	// BIP0034 - block version 2 needs block height at start of coinbase
-	coinbaseScript.AddInt64(int64(newBlockHeight))
-	coinbaseScript.AddInt64(int64(newExtraNonce))
-	coinbaseScript.AddData([]byte(coinbaseFlags))
-	coinbaseTx, err := GenerateCoinbaseTx(coinbaseScript.Script(), subsidyAddress)
+	candidates, skipped, err := calcBlockTx(chain, txs, newBlockHeight)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	report := &BlockReport{Skipped: skipped}
 
-	newMsgBlock.AddTransaction(coinbaseTx)
+	blockTxs := candidates
+	if opts.Policy != nil {
+		blockTxs = opts.Policy.SelectTxs(candidates)
+		report.skipUnselected(candidates, blockTxs)
+	}
+	blockTxs = report.dropOrphans(blockTxs)
+	blockTxs, err = orderBlockTxs(blockTxs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the coinbase size doesn't depend on the fees, so measure it before
+	// limiting the transactions to the space left in the block
+	coinbaseScript, coinbaseTxOuts, err := opts.Coinbase(newBlockHeight, newExtraNonce,
+		subsidy, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	coinbaseSize := newCoinbaseTx(coinbaseScript, coinbaseTxOuts).SerializeSize()
+	maxTxsSize := btcwire.MaxBlockPayload - blockOverheadSize - coinbaseSize - extraNonceReserveSize
+	blockTxs = report.limitSize(blockTxs, maxTxsSize)
+	blockTxs = report.dropOrphans(blockTxs)
 
 	// calculate fees and total value for coinbase
 	var totalFees int64
+	for _, blockTx := range blockTxs {
+		totalFees += blockTx.Fee
+	}
+	report.Included = blockTxs
+	report.TotalFees = totalFees
 
-	blockTxs, err := calcBlockTx(chain, txs)
+	// add coinbase transaction
+	coinbaseScript, coinbaseTxOuts, err = opts.Coinbase(newBlockHeight, newExtraNonce,
+		subsidy, totalFees)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	newMsgBlock.AddTransaction(newCoinbaseTx(coinbaseScript, coinbaseTxOuts))
 	for _, blockTx := range blockTxs {
-		mtx := blockTx.Tx.MsgTx()
-		// check inputs
-		var inputValue int64
-		for n := 0; n < len(blockTx.TxInputAmounts); n++ {
-			inputValue += blockTx.TxInputAmounts[n]
-		}
-
-		var outputValue int64
-		for _, txOut := range mtx.TxOut {
-			outputValue += txOut.Value
-		}
-
-		totalFees += (inputValue - outputValue)
-		newMsgBlock.AddTransaction(mtx)
+		newMsgBlock.AddTransaction(blockTx.Tx.MsgTx())
 	}
 
-	// set coinbase value correctly
-	coinbaseTx.TxOut[0].Value = totalFees + miningParams.BlockSubsidy(newBlockHeight)
-
 	// set merkle root
 	newBlock := btcutil.NewBlock(newMsgBlock)
 	newBlock.SetHeight(newBlockHeight)
-	merkleTreeStore := btcchain.BuildMerkleTreeStore(newBlock.Transactions())
-	newMsgBlock.Header.MerkleRoot = *merkleTreeStore[len(merkleTreeStore)-1]
-
-	return CalculateNewBlockHash(newBlock)
-}
+	updateMerkleRoot(newMsgBlock)
 
-// CalculateNewBlockHash iterates mutable fields to attempt to calculate
-// a mutable block.
-func CalculateNewBlockHash(newBlock *btcutil.Block) (*btcutil.Block, error) {
-	msgBlock := newBlock.MsgBlock()
-
-	// loop over standard block header nonce to get valid hash
-	target := btcchain.CompactToBig(msgBlock.Header.Bits)
-	for ; msgBlock.Header.Nonce < math.MaxInt32; msgBlock.Header.Nonce++ {
-		hash, err := msgBlock.BlockSha()
+	// roll the extra nonce by regenerating the coinbase
+	updateExtraNonce := func(msgBlock *btcwire.MsgBlock, extraNonce uint64) error {
+		coinbaseScript, coinbaseTxOuts, err := opts.Coinbase(newBlockHeight, extraNonce,
+			subsidy, totalFees)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		msgBlock.Transactions[0] = newCoinbaseTx(coinbaseScript, coinbaseTxOuts)
+		updateMerkleRoot(msgBlock)
+		return nil
+	}
 
-		hashNum := btcchain.ShaHashToBig(&hash)
-		if hashNum.Cmp(target) <= 0 && hashNum.Cmp(bitcoindMinTarget) <= 0 {
-			return newBlock, nil
-		}
+	solvedBlock, stats, err := solveBlock(opts.Context, newBlock, updateExtraNonce, opts.Solver)
+	if err != nil {
+		return nil, nil, err
 	}
+	report.Solve = stats
+	return solvedBlock, report, nil
+}
+
+// updateMerkleRoot sets the merkle root in the header of msgBlock to match
+// its transactions.
+func updateMerkleRoot(msgBlock *btcwire.MsgBlock) {
+	txs := make([]*btcutil.Tx, len(msgBlock.Transactions))
+	for i, mtx := range msgBlock.Transactions {
+		txs[i] = btcutil.NewTx(mtx)
+	}
+	merkleTreeStore := btcchain.BuildMerkleTreeStore(txs)
+	msgBlock.Header.MerkleRoot = *merkleTreeStore[len(merkleTreeStore)-1]
+}
 
-	return nil, ErrValidBlockHashNotFound
+// extraNonceUpdater replaces the coinbase of msgBlock with one using
+// extraNonce and updates the merkle root to match.
+type extraNonceUpdater func(msgBlock *btcwire.MsgBlock, extraNonce uint64) error
+
+// CalculateNewBlockHash iterates mutable fields to attempt to calculate
+// a mutable block.  Since the coinbase of newBlock can't be regenerated,
+// it returns ErrValidBlockHashNotFound when the header nonce space is
+// exhausted.
+func CalculateNewBlockHash(newBlock *btcutil.Block) (*btcutil.Block, error) {
+	solvedBlock, _, err := solveBlock(context.Background(), newBlock, nil, nil)
+	return solvedBlock, err
 }
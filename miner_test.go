@@ -0,0 +1,89 @@
+package regtester
+
+import (
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// newTestBlockTx returns a BlockTx with a single output of value that
+// spends output 0 of each of parents.
+func newTestBlockTx(value int64, parents ...*BlockTx) *BlockTx {
+	mtx := btcwire.NewMsgTx()
+	for _, parent := range parents {
+		prevOut := btcwire.NewOutPoint(parent.Tx.Sha(), 0)
+		mtx.AddTxIn(btcwire.NewTxIn(prevOut, nil))
+	}
+	mtx.AddTxOut(btcwire.NewTxOut(value, nil))
+	return &BlockTx{Tx: btcutil.NewTx(mtx)}
+}
+
+func TestOrderBlockTxs(t *testing.T) {
+	outside := newTestBlockTx(0)
+	a := newTestBlockTx(1)
+	b := newTestBlockTx(2, a)
+	c := newTestBlockTx(3, b)
+	d := newTestBlockTx(4, outside)
+	e := newTestBlockTx(5, a, d)
+
+	tests := []struct {
+		name string
+		in   []*BlockTx
+		want []*BlockTx
+	}{
+		{"empty", []*BlockTx{}, []*BlockTx{}},
+		{"independent txs keep their order", []*BlockTx{d, a}, []*BlockTx{d, a}},
+		{"parent moved before child", []*BlockTx{b, a}, []*BlockTx{a, b}},
+		{"chain reversed", []*BlockTx{c, b, a}, []*BlockTx{a, b, c}},
+		{"already ordered", []*BlockTx{a, b, c}, []*BlockTx{a, b, c}},
+		{"outside parents ignored", []*BlockTx{d, c, b}, []*BlockTx{d, b, c}},
+		{"multiple parents", []*BlockTx{e, c, d, a}, []*BlockTx{a, d, e, c}},
+	}
+
+	for _, test := range tests {
+		got, err := orderBlockTxs(test.in)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %d txs, want %d", test.name, len(got), len(test.want))
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: tx %d: got %v, want %v", test.name, i,
+					got[i].Tx.Sha(), test.want[i].Tx.Sha())
+			}
+		}
+	}
+}
+
+func TestOrderBlockTxsCycle(t *testing.T) {
+	// a transaction hash commits to its inputs so a real cycle can't be
+	// built; instead the inputs are rewritten after the hashes are cached.
+	a := newTestBlockTx(1)
+	b := newTestBlockTx(2, a)
+	a.Tx.MsgTx().AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(b.Tx.Sha(), 0), nil))
+
+	self := newTestBlockTx(3)
+	self.Tx.MsgTx().AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(self.Tx.Sha(), 0), nil))
+
+	c := newTestBlockTx(4)
+
+	tests := []struct {
+		name string
+		in   []*BlockTx
+	}{
+		{"two tx cycle", []*BlockTx{a, b}},
+		{"two tx cycle after independent tx", []*BlockTx{c, b, a}},
+		{"tx spends itself", []*BlockTx{self}},
+	}
+
+	for _, test := range tests {
+		_, err := orderBlockTxs(test.in)
+		if err != ErrTxDependencyCycle {
+			t.Errorf("%s: got error %v, want %v", test.name, err, ErrTxDependencyCycle)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package regtester
+
+import (
+	"errors"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// maxPubKeysPerMultiSig is the most public keys allowed by
+// OP_CHECKMULTISIG.
+const maxPubKeysPerMultiSig = 20
+
+var (
+	ErrInvalidMultiSig = errors.New("multisig must require between 1 and the number of public keys")
+	ErrNoSigningKeys   = errors.New("no keys to sign the transaction input")
+)
+
+// MultiSigScript returns a script requiring signatures from required of
+// pubKeys.
+func MultiSigScript(required int, pubKeys ...[]byte) ([]byte, error) {
+	if required < 1 || required > len(pubKeys) || len(pubKeys) > maxPubKeysPerMultiSig {
+		return nil, ErrInvalidMultiSig
+	}
+
+	builder := btcscript.NewScriptBuilder()
+	builder.AddInt64(int64(required))
+	for _, pubKey := range pubKeys {
+		builder.AddData(pubKey)
+	}
+	builder.AddInt64(int64(len(pubKeys)))
+	builder.AddOp(btcscript.OP_CHECKMULTISIG)
+	return builder.Script(), nil
+}
+
+// MultiSigScriptFromWifs returns a script requiring signatures from
+// required of the keys encoded in pkWifs.
+func MultiSigScriptFromWifs(required int, pkWifs ...string) ([]byte, error) {
+	pubKeys := make([][]byte, len(pkWifs))
+	for i, pkWif := range pkWifs {
+		pubKey, err := PubKeyFromWif(pkWif)
+		if err != nil {
+			return nil, err
+		}
+		pubKeys[i] = pubKey
+	}
+	return MultiSigScript(required, pubKeys...)
+}
+
+// MultiSigTxOut returns a bare multisig output of value requiring
+// signatures from required of pubKeys.
+func MultiSigTxOut(required int, pubKeys [][]byte, value int64) (*btcwire.TxOut, error) {
+	pkScript, err := MultiSigScript(required, pubKeys...)
+	if err != nil {
+		return nil, err
+	}
+	return &btcwire.TxOut{
+		Value:    value,
+		PkScript: pkScript,
+	}, nil
+}
+
+// ScriptHashAddress returns the pay-to-script-hash address of
+// redeemScript.
+func ScriptHashAddress(net btcwire.BitcoinNet, redeemScript []byte) (btcutil.Address, error) {
+	return btcutil.NewAddressScriptHash(redeemScript, net)
+}
+
+// ScriptHashTxOut returns a pay-to-script-hash output of value committing
+// to redeemScript.
+func ScriptHashTxOut(net btcwire.BitcoinNet, redeemScript []byte, value int64) (*btcwire.TxOut, error) {
+	address, err := ScriptHashAddress(net, redeemScript)
+	if err != nil {
+		return nil, err
+	}
+	pkScript, err := btcscript.PayToAddrScript(address)
+	if err != nil {
+		log.Errorf("Failed to generate pay to script hash script: error=%v", err)
+		return nil, err
+	}
+	return &btcwire.TxOut{
+		Value:    value,
+		PkScript: pkScript,
+	}, nil
+}
+
+// MultiSigScriptHashTxOut returns a pay-to-script-hash output of value
+// committing to a multisig script requiring signatures from required of
+// pubKeys, along with the redeem script needed to spend it.
+func MultiSigScriptHashTxOut(net btcwire.BitcoinNet, required int, pubKeys [][]byte, value int64) (*btcwire.TxOut, []byte, error) {
+	redeemScript, err := MultiSigScript(required, pubKeys...)
+	if err != nil {
+		return nil, nil, err
+	}
+	txOut, err := ScriptHashTxOut(net, redeemScript, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return txOut, redeemScript, nil
+}
+
+// isMultiSigScript returns whether script ends in OP_CHECKMULTISIG.
+func isMultiSigScript(script []byte) bool {
+	return len(script) > 0 && script[len(script)-1] == btcscript.OP_CHECKMULTISIG
+}
+
+// SignTxIn sets the signature script of input i of mtx to spend the output
+// described by txIn.  It can be used to sign inputs left Unsigned by
+// BuildTransaction or added afterwards; wrap mtx in a new btcutil.Tx once
+// signed since the transaction hash changes.
+func SignTxIn(mtx *btcwire.MsgTx, i int, txIn *TxInDetails) error {
+	if i < 0 || i >= len(mtx.TxIn) {
+		return ErrInvalidInputIndex
+	}
+	if txIn.Index >= uint32(len(txIn.Tx.MsgTx().TxOut)) {
+		return ErrInvalidOutpointIndex
+	}
+
+	hashType := txIn.hashType()
+	pkScript := txIn.Tx.MsgTx().TxOut[txIn.Index].PkScript
+	switch {
+	case txIn.RedeemScript != nil:
+		var sigScript []byte
+		var err error
+		if isMultiSigScript(txIn.RedeemScript) {
+			sigScript, err = multiSigScriptSig(mtx, i, txIn.RedeemScript, txIn.PkWifs, hashType)
+		} else {
+			sigScript, err = singleSigScriptSig(mtx, i, txIn.RedeemScript, txIn.PkWif, hashType)
+		}
+		if err != nil {
+			return err
+		}
+		builder := btcscript.NewScriptBuilder()
+		builder.AddData(txIn.RedeemScript)
+		mtx.TxIn[i].SignatureScript = append(sigScript, builder.Script()...)
+		return nil
+
+	case len(txIn.PkWifs) > 0:
+		sigScript, err := multiSigScriptSig(mtx, i, pkScript, txIn.PkWifs, hashType)
+		if err != nil {
+			return err
+		}
+		mtx.TxIn[i].SignatureScript = sigScript
+		return nil
+	}
+
+	return signInput(mtx, i, pkScript, txIn.PkWif, hashType)
+}
+
+// multiSigScriptSig returns the signatures of pkWifs over input i of mtx
+// prefixed with the extra value popped by OP_CHECKMULTISIG.
+func multiSigScriptSig(mtx *btcwire.MsgTx, i int, subscript []byte, pkWifs []string, hashType byte) ([]byte, error) {
+	if len(pkWifs) == 0 {
+		return nil, ErrNoSigningKeys
+	}
+
+	builder := btcscript.NewScriptBuilder()
+	builder.AddOp(btcscript.OP_0)
+	for _, pkWif := range pkWifs {
+		privateKey, _, err := decodeKeyPair(pkWif)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := btcscript.RawTxInSignature(mtx, i, subscript, hashType, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		builder.AddData(sig)
+	}
+	return builder.Script(), nil
+}
+
+// singleSigScriptSig returns the signature of pkWif over input i of mtx
+// for a redeem script such as <pubkey> OP_CHECKSIG that only needs the
+// signature.
+func singleSigScriptSig(mtx *btcwire.MsgTx, i int, subscript []byte, pkWif string, hashType byte) ([]byte, error) {
+	if pkWif == "" {
+		return nil, ErrNoSigningKeys
+	}
+
+	privateKey, _, err := decodeKeyPair(pkWif)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := btcscript.RawTxInSignature(mtx, i, subscript, hashType, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := btcscript.NewScriptBuilder()
+	builder.AddData(sig)
+	return builder.Script(), nil
+}
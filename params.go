@@ -1,52 +1,166 @@
 package regtester
 
 import (
+	"errors"
 	"github.com/conformal/btcchain"
 	"github.com/conformal/btcutil"
 	"github.com/conformal/btcwire"
+	"time"
 )
 
+var (
+	ErrUnknownNet          = errors.New("no mining params registered for network")
+	ErrDuplicateNet        = errors.New("mining params already registered for network")
+	ErrInvalidMiningParams = errors.New("invalid mining params")
+)
+
+// MiningParams holds the consensus settings used to generate blocks for a
+// network.  They can be constructed by hand and registered with
+// RegisterMiningParams to generate blocks for custom networks.
 type MiningParams struct {
+	Net btcwire.BitcoinNet
+
+	// Subsidy is the block subsidy in satoshi before any halvings.
 	Subsidy                int64
 	SubsidyHalvingInterval int64
-	ChainParams            *btcchain.Params
+
+	// CoinbaseMaturity is the number of blocks required before a coinbase
+	// output can be spent.
+	CoinbaseMaturity int64
+
+	// ChainParams holds the genesis block and proof of work limit.
+	ChainParams *btcchain.Params
+
+	// TargetTimespan is the desired amount of time between difficulty
+	// retargets and TargetSpacing the desired amount of time between blocks.
+	TargetTimespan time.Duration
+	TargetSpacing  time.Duration
+
+	// RetargetAdjustmentFactor limits how much the difficulty can change
+	// in either direction at a single retarget.
+	RetargetAdjustmentFactor int64
+
+	// ReduceMinDifficulty allows minimum difficulty blocks when more than
+	// twice TargetSpacing has passed since the previous block (testnet rules).
+	ReduceMinDifficulty bool
 }
 
+// BlockSubsidy returns the subsidy for a block at height, halving
+// Subsidy every SubsidyHalvingInterval blocks.
 func (mp *MiningParams) BlockSubsidy(height int64) int64 {
-	subsidy := 50 * btcutil.SatoshiPerBitcoin
-	subsidy >>= uint64(height / mp.SubsidyHalvingInterval)
-	return subsidy
+	if mp.SubsidyHalvingInterval == 0 {
+		return mp.Subsidy
+	}
+
+	halvings := height / mp.SubsidyHalvingInterval
+	if halvings >= 64 {
+		return 0
+	}
+	return mp.Subsidy >> uint64(halvings)
+}
+
+// BlocksPerRetarget returns the number of blocks between difficulty retargets.
+func (mp *MiningParams) BlocksPerRetarget() int64 {
+	return int64(mp.TargetTimespan / mp.TargetSpacing)
+}
+
+// validate checks that the params can be used to generate blocks.
+func (mp *MiningParams) validate() error {
+	if mp.Subsidy < 0 || mp.SubsidyHalvingInterval < 0 || mp.CoinbaseMaturity < 0 {
+		return ErrInvalidMiningParams
+	}
+	if mp.ChainParams == nil || mp.ChainParams.GenesisBlock == nil || mp.ChainParams.GenesisHash == nil ||
+		mp.ChainParams.PowLimit == nil {
+		return ErrInvalidMiningParams
+	}
+	genesisHash, err := mp.ChainParams.GenesisBlock.BlockSha()
+	if err != nil || !genesisHash.IsEqual(mp.ChainParams.GenesisHash) {
+		return ErrInvalidMiningParams
+	}
+	if mp.TargetSpacing <= 0 || mp.TargetTimespan < mp.TargetSpacing || mp.RetargetAdjustmentFactor <= 0 {
+		return ErrInvalidMiningParams
+	}
+	return nil
 }
 
 var (
 	mainNetMiningParams = MiningParams{
-		Subsidy:                50,
-		SubsidyHalvingInterval: 210000,
-		ChainParams:            btcchain.ChainParams(btcwire.MainNet),
+		Net:                      btcwire.MainNet,
+		Subsidy:                  50 * btcutil.SatoshiPerBitcoin,
+		SubsidyHalvingInterval:   210000,
+		CoinbaseMaturity:         100,
+		ChainParams:              btcchain.ChainParams(btcwire.MainNet),
+		TargetTimespan:           time.Hour * 24 * 14,
+		TargetSpacing:            time.Minute * 10,
+		RetargetAdjustmentFactor: 4,
+		ReduceMinDifficulty:      false,
 	}
 
 	testNetMiningParams = MiningParams{
-		Subsidy:                50,
-		SubsidyHalvingInterval: 210000,
-		ChainParams:            btcchain.ChainParams(btcwire.TestNet3),
+		Net:                      btcwire.TestNet3,
+		Subsidy:                  50 * btcutil.SatoshiPerBitcoin,
+		SubsidyHalvingInterval:   210000,
+		CoinbaseMaturity:         100,
+		ChainParams:              btcchain.ChainParams(btcwire.TestNet3),
+		TargetTimespan:           time.Hour * 24 * 14,
+		TargetSpacing:            time.Minute * 10,
+		RetargetAdjustmentFactor: 4,
+		ReduceMinDifficulty:      true,
 	}
 
 	regressionNetMiningParams = MiningParams{
-		Subsidy:                50,
-		SubsidyHalvingInterval: 150,
-		ChainParams:            btcchain.ChainParams(btcwire.TestNet),
+		Net:                      btcwire.TestNet,
+		Subsidy:                  50 * btcutil.SatoshiPerBitcoin,
+		SubsidyHalvingInterval:   150,
+		CoinbaseMaturity:         100,
+		ChainParams:              btcchain.ChainParams(btcwire.TestNet),
+		TargetTimespan:           time.Hour * 24 * 14,
+		TargetSpacing:            time.Minute * 10,
+		RetargetAdjustmentFactor: 4,
+		ReduceMinDifficulty:      true,
+	}
+
+	registeredMiningParams = map[btcwire.BitcoinNet]*MiningParams{
+		btcwire.MainNet:  &mainNetMiningParams,
+		btcwire.TestNet3: &testNetMiningParams,
+		btcwire.TestNet:  &regressionNetMiningParams,
 	}
 )
 
-func ChainMiningParams(btcnet btcwire.BitcoinNet) *MiningParams {
-	switch btcnet {
-	case btcwire.TestNet:
-		return &regressionNetMiningParams
-	case btcwire.TestNet3:
-		return &testNetMiningParams
-	case btcwire.MainNet:
-		fallthrough
-	default:
-		return &mainNetMiningParams
+// RegisterMiningParams registers params for params.Net so blocks can be
+// generated and synced for custom networks.  It should be called before
+// any blocks are generated, typically from an init function.
+// NOTE: btcchain only has consensus rules for the built-in networks, so
+// blocks of a custom network are added to the local db without being
+// validated and the local db can only follow the best chain; btcd still
+// validates them when they're submitted.
+func RegisterMiningParams(params *MiningParams) error {
+	err := params.validate()
+	if err != nil {
+		return err
+	}
+	if _, ok := registeredMiningParams[params.Net]; ok {
+		return ErrDuplicateNet
+	}
+	registeredMiningParams[params.Net] = params
+	return nil
+}
+
+// validatesLocally returns whether btcchain has the consensus rules of net
+// so its blocks can be processed by the local chain.
+func validatesLocally(net btcwire.BitcoinNet) bool {
+	switch net {
+	case btcwire.MainNet, btcwire.TestNet, btcwire.TestNet3:
+		return true
+	}
+	return false
+}
+
+// ChainMiningParams returns the mining params registered for btcnet.
+func ChainMiningParams(btcnet btcwire.BitcoinNet) (*MiningParams, error) {
+	params, ok := registeredMiningParams[btcnet]
+	if !ok {
+		return nil, ErrUnknownNet
 	}
+	return params, nil
 }
@@ -0,0 +1,115 @@
+package regtester
+
+import (
+	"github.com/conformal/btcwire"
+	"sort"
+)
+
+// TxSelectionPolicy chooses which candidate transactions are included in a
+// new block and in which order.
+type TxSelectionPolicy interface {
+	SelectTxs(candidates []*BlockTx) []*BlockTx
+}
+
+// TxSelectionPolicyFunc adapts an ordinary function to a TxSelectionPolicy.
+type TxSelectionPolicyFunc func(candidates []*BlockTx) []*BlockTx
+
+// SelectTxs calls f(candidates).
+func (f TxSelectionPolicyFunc) SelectTxs(candidates []*BlockTx) []*BlockTx {
+	return f(candidates)
+}
+
+// FeeRatePolicy orders transactions by fee per kilobyte, highest first.
+type FeeRatePolicy struct{}
+
+// SelectTxs returns the candidates ordered by fee rate.
+func (p FeeRatePolicy) SelectTxs(candidates []*BlockTx) []*BlockTx {
+	selected := append([]*BlockTx{}, candidates...)
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].FeePerKb() > selected[j].FeePerKb()
+	})
+	return selected
+}
+
+// PriorityPolicy orders transactions by priority, highest first.
+type PriorityPolicy struct{}
+
+// SelectTxs returns the candidates ordered by priority.
+func (p PriorityPolicy) SelectTxs(candidates []*BlockTx) []*BlockTx {
+	selected := append([]*BlockTx{}, candidates...)
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].Priority > selected[j].Priority
+	})
+	return selected
+}
+
+// ListPolicy filters transactions by hash.  When Include is non-empty only
+// the listed transactions are kept, and any transaction in Exclude is
+// always dropped.
+type ListPolicy struct {
+	Include []*btcwire.ShaHash
+	Exclude []*btcwire.ShaHash
+}
+
+// SelectTxs returns the candidates allowed by the include and exclude lists.
+func (p ListPolicy) SelectTxs(candidates []*BlockTx) []*BlockTx {
+	selected := make([]*BlockTx, 0, len(candidates))
+	for _, candidate := range candidates {
+		sha := candidate.Tx.Sha()
+		if len(p.Include) > 0 && !containsSha(p.Include, sha) {
+			continue
+		}
+		if containsSha(p.Exclude, sha) {
+			continue
+		}
+		selected = append(selected, candidate)
+	}
+	return selected
+}
+
+// LimitPolicy keeps transactions in order while they fit within the
+// limits.  MaxSize is the limit on the total serialized size of the
+// selected transactions, not counting the header and coinbase.  A zero
+// limit isn't enforced.
+type LimitPolicy struct {
+	MaxSize   int
+	MaxSigOps int
+}
+
+// SelectTxs returns the candidates that fit within the limits.
+func (p LimitPolicy) SelectTxs(candidates []*BlockTx) []*BlockTx {
+	selected := make([]*BlockTx, 0, len(candidates))
+	var size, sigOps int
+	for _, candidate := range candidates {
+		if p.MaxSize > 0 && size+candidate.Size > p.MaxSize {
+			continue
+		}
+		if p.MaxSigOps > 0 && sigOps+candidate.SigOps > p.MaxSigOps {
+			continue
+		}
+		size += candidate.Size
+		sigOps += candidate.SigOps
+		selected = append(selected, candidate)
+	}
+	return selected
+}
+
+// PolicyChain applies each policy in turn to the output of the previous
+// one, for example ordering by fee rate before applying a size limit.
+func PolicyChain(policies ...TxSelectionPolicy) TxSelectionPolicy {
+	return TxSelectionPolicyFunc(func(candidates []*BlockTx) []*BlockTx {
+		for _, policy := range policies {
+			candidates = policy.SelectTxs(candidates)
+		}
+		return candidates
+	})
+}
+
+func containsSha(shas []*btcwire.ShaHash, sha *btcwire.ShaHash) bool {
+	for _, s := range shas {
+		if s.IsEqual(sha) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package regtester
+
+import (
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// SkipReason describes why a transaction was left out of a block.
+type SkipReason int
+
+const (
+	// SkipMissingInput means an input isn't in the chain or the block.
+	SkipMissingInput SkipReason = iota
+
+	// SkipInvalidOutpoint means an input refers to an output index that
+	// doesn't exist.
+	SkipInvalidOutpoint
+
+	// SkipNegativeFee means the outputs are worth more than the inputs.
+	SkipNegativeFee
+
+	// SkipExceedsSize means the transaction doesn't fit in the block.
+	SkipExceedsSize
+
+	// SkipNotSelected means the selection policy left it out.
+	SkipNotSelected
+)
+
+var skipReasonStrings = map[SkipReason]string{
+	SkipMissingInput:    "missing input",
+	SkipInvalidOutpoint: "invalid outpoint",
+	SkipNegativeFee:     "negative fee",
+	SkipExceedsSize:     "exceeds size",
+	SkipNotSelected:     "not selected",
+}
+
+func (r SkipReason) String() string {
+	if s, ok := skipReasonStrings[r]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// SkippedTx is a transaction that was left out of a block.
+type SkippedTx struct {
+	Tx     *btcutil.Tx
+	Reason SkipReason
+}
+
+// BlockReport describes how the transactions of a block were assembled.
+type BlockReport struct {
+	// Included holds the transactions in the block in block order, not
+	// counting the coinbase.
+	Included []*BlockTx
+
+	// Skipped holds the transactions that were left out.
+	Skipped []*SkippedTx
+
+	// TotalFees is the sum of the fees of the included transactions.
+	TotalFees int64
+
+	// Solve reports the hashes and extra nonce rolls needed to solve the
+	// proof of work of the block.
+	Solve *SolveStats
+}
+
+// skip records tx as skipped for reason.
+func (r *BlockReport) skip(tx *btcutil.Tx, reason SkipReason) {
+	log.Infof("Skipping transaction: tx.sha=%v, reason=%v", tx.Sha(), reason)
+	r.Skipped = append(r.Skipped, &SkippedTx{
+		Tx:     tx,
+		Reason: reason,
+	})
+}
+
+// skipUnselected records the candidates missing from selected as skipped.
+func (r *BlockReport) skipUnselected(candidates, selected []*BlockTx) {
+	kept := make(map[*BlockTx]bool, len(selected))
+	for _, blockTx := range selected {
+		kept[blockTx] = true
+	}
+	for _, blockTx := range candidates {
+		if !kept[blockTx] {
+			r.skip(blockTx.Tx, SkipNotSelected)
+		}
+	}
+}
+
+// dropOrphans removes transactions spending from transactions of the batch
+// that are no longer in blockTxs, repeating until every remaining
+// transaction has all of its in-block parents.
+func (r *BlockReport) dropOrphans(blockTxs []*BlockTx) []*BlockTx {
+	for {
+		present := make(map[btcwire.ShaHash]bool, len(blockTxs))
+		for _, blockTx := range blockTxs {
+			present[*blockTx.Tx.Sha()] = true
+		}
+
+		kept := make([]*BlockTx, 0, len(blockTxs))
+		for _, blockTx := range blockTxs {
+			orphan := false
+			for _, parent := range blockTx.parents {
+				if !present[parent] {
+					orphan = true
+					break
+				}
+			}
+			if orphan {
+				r.skip(blockTx.Tx, SkipMissingInput)
+				continue
+			}
+			kept = append(kept, blockTx)
+		}
+
+		if len(kept) == len(blockTxs) {
+			return kept
+		}
+		blockTxs = kept
+	}
+}
+
+// limitSize removes the transactions that don't fit in maxSize bytes,
+// keeping the earlier ones.
+func (r *BlockReport) limitSize(blockTxs []*BlockTx, maxSize int) []*BlockTx {
+	kept := make([]*BlockTx, 0, len(blockTxs))
+	var size int
+	for _, blockTx := range blockTxs {
+		if size+blockTx.Size > maxSize {
+			r.skip(blockTx.Tx, SkipExceedsSize)
+			continue
+		}
+		size += blockTx.Size
+		kept = append(kept, blockTx)
+	}
+	return kept
+}
@@ -72,7 +72,7 @@ func main() {
 
 	// ensure height is up to 110 so first few blocks are spendable.
 	for height := prevBlock.Height(); height < 110; height++ {
-		newBlock, err := regtester.ExtendChainEmpty(net, chain, prevBlock, subsidyAddress, btcd)
+		newBlock, err := regtester.ExtendChainEmpty(net, chain, db, prevBlock, subsidyAddress, btcd)
 		if err != nil {
 			log.Errorf("Failed to extend chain with empty block")
 			return
@@ -95,7 +95,7 @@ func main() {
 		return
 	}
 
-	_, err = regtester.ExtendChainWithAllMempool(net, chain, prevBlock, subsidyAddress, btcd)
+	_, err = regtester.ExtendChainWithAllMempool(net, chain, db, prevBlock, subsidyAddress, btcd)
 	if err != nil {
 		log.Errorf("Failed to extend chain with mempool transactions")
 		return
@@ -24,6 +24,49 @@ type TxInDetails struct {
 	Tx    *btcutil.Tx
 	Index uint32
 	PkWif string
+
+	// PkWifs are the keys signing a multisig output, in the same order
+	// as their public keys appear in the script.
+	PkWifs []string
+
+	// RedeemScript is the script committed to by a pay-to-script-hash
+	// output.  It's signed with PkWifs if it's a multisig script and
+	// with PkWif otherwise.
+	RedeemScript []byte
+
+	// HashType is the signature hash type used to sign the input, such
+	// as btcscript.SigHashSingle|btcscript.SigHashAnyOneCanPay.  Nil
+	// means btcscript.SigHashAll.
+	HashType *byte
+
+	// Unsigned leaves the signature script of the input empty so it can
+	// be signed later with SignTxIn.
+	Unsigned bool
+
+	// Sequence is the sequence number of the input.  Nil means
+	// btcwire.MaxTxInSequenceNum, or zero when the transaction has a lock
+	// time so that the lock is enforced.
+	Sequence *uint32
+}
+
+// hashType returns the signature hash type used to sign the input.
+func (t *TxInDetails) hashType() byte {
+	if t.HashType == nil {
+		return btcscript.SigHashAll
+	}
+	return *t.HashType
+}
+
+// sequence returns the sequence number of the input in a transaction with
+// lockTime.
+func (t *TxInDetails) sequence(lockTime uint32) uint32 {
+	switch {
+	case t.Sequence != nil:
+		return *t.Sequence
+	case lockTime != 0:
+		return 0
+	}
+	return btcwire.MaxTxInSequenceNum
 }
 
 func decodeKeyPair(pkWif string) (*ecdsa.PrivateKey, bool, error) {
@@ -46,10 +89,95 @@ func decodeKeyPair(pkWif string) (*ecdsa.PrivateKey, bool, error) {
 	}, compressed, nil
 }
 
+// signInput sets the signature script of input i of mtx to spend the
+// pay-to-pubkey-hash output with subscript using the key in pkWif.
+func signInput(mtx *btcwire.MsgTx, i int, subscript []byte, pkWif string, hashType byte) error {
+	privateKey, compress, err := decodeKeyPair(pkWif)
+	if err != nil {
+		return err
+	}
+
+	scriptSig, err := btcscript.SignatureScript(mtx, i, subscript, hashType,
+		privateKey, compress)
+	if err != nil {
+		return err
+	}
+
+	mtx.TxIn[i].SignatureScript = scriptSig
+	return nil
+}
+
 // SendTransaction creates a signed transaction and sends to
 // btcd using sendrawtransaction.
 func SendTransaction(net btcwire.BitcoinNet, txIns []*TxInDetails, txOuts []*btcwire.TxOut, btcd *btcdcommander.Commander) (*btcutil.Tx, error) {
+	return SendTransactionWithLockTime(net, txIns, txOuts, 0, btcd)
+}
+
+// SendTransactionWithLockTime creates a signed transaction that can't be
+// included in a block until lockTime and sends it to btcd using
+// sendrawtransaction.
+func SendTransactionWithLockTime(net btcwire.BitcoinNet, txIns []*TxInDetails, txOuts []*btcwire.TxOut, lockTime uint32, btcd *btcdcommander.Commander) (*btcutil.Tx, error) {
+	tx, txHex, err := BuildTransactionWithLockTime(txIns, txOuts, lockTime)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sendTxHex(txHex, btcd)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// BuildTransaction creates a signed transaction and returns it along with
+// its hex encoding without sending it to btcd.
+func BuildTransaction(txIns []*TxInDetails, txOuts []*btcwire.TxOut) (*btcutil.Tx, string, error) {
+	return BuildTransactionWithLockTime(txIns, txOuts, 0)
+}
+
+// BuildTransactionWithLockTime creates a signed transaction that can't be
+// included in a block until lockTime and returns it along with its hex
+// encoding without sending it to btcd.  Lock times below
+// LockTimeThreshold are block heights and the rest are unix times.
+func BuildTransactionWithLockTime(txIns []*TxInDetails, txOuts []*btcwire.TxOut, lockTime uint32) (*btcutil.Tx, string, error) {
+	mtx, err := buildTransaction(txIns, txOuts, lockTime)
+	if err != nil {
+		return nil, "", err
+	}
+
+	txHex, err := msgTxHex(mtx)
+	if err != nil {
+		return nil, "", err
+	}
+	return btcutil.NewTx(mtx), txHex, nil
+}
+
+// msgTxHex returns the hex encoding of the serialized mtx.
+func msgTxHex(mtx *btcwire.MsgTx) (string, error) {
+	txBytes := new(bytes.Buffer)
+	err := mtx.Serialize(txBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(txBytes.Bytes()), nil
+}
+
+// sendTxHex sends the hex encoded transaction to btcd using
+// sendrawtransaction.
+func sendTxHex(txHex string, btcd *btcdcommander.Commander) error {
+	log.Infof("Tx hex: %s", txHex)
+	_, jsonErr := btcd.SendRawTransaction(txHex)
+	if jsonErr != nil {
+		return errors.New(jsonErr.Message)
+	}
+	return nil
+}
+
+// buildTransaction creates a transaction spending txIns to txOuts with
+// every input signed unless marked Unsigned.
+func buildTransaction(txIns []*TxInDetails, txOuts []*btcwire.TxOut, lockTime uint32) (*btcwire.MsgTx, error) {
 	mtx := btcwire.NewMsgTx()
+	mtx.LockTime = lockTime
 	for _, txIn := range txIns {
 		if txIn.Index >= uint32(len(txIn.Tx.MsgTx().TxOut)) {
 			return nil, ErrInvalidOutpointIndex
@@ -57,44 +185,25 @@ func SendTransaction(net btcwire.BitcoinNet, txIns []*TxInDetails, txOuts []*btc
 		mtx.AddTxIn(&btcwire.TxIn{
 			PreviousOutpoint: btcwire.OutPoint{*txIn.Tx.Sha(), txIn.Index},
 			SignatureScript:  nil,
-			Sequence:         btcwire.MaxTxInSequenceNum,
+			Sequence:         txIn.sequence(lockTime),
 		})
 	}
 	for _, txOut := range txOuts {
 		mtx.AddTxOut(txOut)
 	}
 
-	// sign each input
+	// sign each input not left for later
 	for i, txIn := range txIns {
-		privateKey, compress, err := decodeKeyPair(txIns[i].PkWif)
-		if err != nil {
-			return nil, err
+		if txIn.Unsigned {
+			continue
 		}
-
-		subscript := txIn.Tx.MsgTx().TxOut[txIn.Index].PkScript
-
-		scriptSig, err := btcscript.SignatureScript(mtx, i, subscript, btcscript.SigHashAll,
-			privateKey, compress)
+		err := SignTxIn(mtx, i, txIn)
 		if err != nil {
 			return nil, err
 		}
-
-		mtx.TxIn[i].SignatureScript = scriptSig
-	}
-
-	txBytes := new(bytes.Buffer)
-	err := mtx.Serialize(txBytes)
-	if err != nil {
-		return nil, err
 	}
 
-	txHex := hex.EncodeToString(txBytes.Bytes())
-	log.Infof("Tx hex: %s", txHex)
-	_, jsonErr := btcd.SendRawTransaction(txHex)
-	if jsonErr != nil {
-		return nil, errors.New(jsonErr.Message)
-	}
-	return btcutil.NewTx(mtx), nil
+	return mtx, nil
 }
 
 func PubKeyHashTxOut(pubKeyHash string, value int64) (*btcwire.TxOut, error) {
@@ -115,8 +224,15 @@ func PubKeyHashTxOut(pubKeyHash string, value int64) (*btcwire.TxOut, error) {
 }
 
 // SpendCoinbaseTransaction sends the coinbase transaction value at
-// the given height to the pubKeyHash specified.
+// the given height to the pubKeyHash specified.  It returns
+// ErrImmatureCoinbase if the coinbase can't be spent in the next block.
 func SpendCoinbaseTransaction(net btcwire.BitcoinNet, db btcdb.Db, btcd *btcdcommander.Commander, height int64, subsidyPrivateKeyWif string, pubKeyHash string) (*btcutil.Tx, error) {
+	err := CheckCoinbaseMaturity(net, db, height)
+	if err != nil {
+		log.Errorf("Failed to spend coinbase transaction: height=%d, error=%v", height, err)
+		return nil, err
+	}
+
 	tx, err := RetrieveCoinbaseTransaction(db, height)
 	if err != nil {
 		log.Error("Failed to retreive coinbase transaction to spend: error=%v", err)
@@ -0,0 +1,198 @@
+package regtester
+
+import (
+	"context"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// solverBatchSize is the number of nonces a single worker searches before
+// the workers synchronize and check for cancellation.
+const solverBatchSize = 1 << 16
+
+// SolverOptions controls how the proof of work for a block is searched.
+type SolverOptions struct {
+	// Workers is the number of goroutines searching the nonce space.
+	// Zero uses one worker per CPU.
+	Workers int
+
+	// Deterministic always returns the lowest valid nonce, the same one a
+	// single worker would find, at the cost of waiting for every worker to
+	// finish its share of the nonce space.  The block is only fully
+	// reproducible when its timestamp is fixed as well.
+	Deterministic bool
+}
+
+// SolveStats reports the work done while solving a block.
+type SolveStats struct {
+	Hashes     uint64
+	ExtraNonce uint64
+	Duration   time.Duration
+}
+
+// HashRate returns the number of hashes per second.
+func (s *SolveStats) HashRate() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Hashes) / s.Duration.Seconds()
+}
+
+// serialSolverOptions searches with a single worker, which is how blocks
+// are solved when no SolverOptions are given.
+var serialSolverOptions = SolverOptions{
+	Workers:       1,
+	Deterministic: true,
+}
+
+// CalculateNewBlockHashWithOptions is like CalculateNewBlockHash but splits
+// the nonce space across opts.Workers goroutines.  The search stops with
+// ctx.Err() when ctx is cancelled.
+func CalculateNewBlockHashWithOptions(ctx context.Context, newBlock *btcutil.Block, opts *SolverOptions) (*btcutil.Block, *SolveStats, error) {
+	return solveBlock(ctx, newBlock, nil, opts)
+}
+
+// solveBlock searches the header nonce space for a hash that meets the
+// target of newBlock.  When the nonce space is exhausted the extra nonce is
+// rolled with updateExtraNonce and the search continues.  The timestamp is
+// never rolled instead since the required bits can depend on it, so with a
+// nil updateExtraNonce ErrValidBlockHashNotFound is returned.
+func solveBlock(ctx context.Context, newBlock *btcutil.Block, updateExtraNonce extraNonceUpdater, opts *SolverOptions) (*btcutil.Block, *SolveStats, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts == nil {
+		opts = &serialSolverOptions
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	msgBlock := newBlock.MsgBlock()
+	header := &msgBlock.Header
+
+	target := btcchain.CompactToBig(header.Bits)
+	if target.Cmp(bitcoindMinTarget) > 0 {
+		target = bitcoindMinTarget
+	}
+	if target.Sign() <= 0 {
+		return nil, nil, ErrValidBlockHashNotFound
+	}
+
+	stats := &SolveStats{}
+	start := time.Now()
+	for {
+		nonce, found, err := searchNonces(ctx, header, target, workers, opts.Deterministic, stats)
+		stats.Duration = time.Since(start)
+		if err != nil {
+			return nil, stats, err
+		}
+		if found {
+			header.Nonce = nonce
+			log.Debugf("Solved block: nonce=%d, extraNonce=%d, hashes=%d, hashRate=%.0f/s",
+				nonce, stats.ExtraNonce, stats.Hashes, stats.HashRate())
+
+			// the coinbase may have changed, so don't reuse any
+			// cached transactions or hashes
+			solvedBlock := btcutil.NewBlock(msgBlock)
+			solvedBlock.SetHeight(newBlock.Height())
+			return solvedBlock, stats, nil
+		}
+
+		header.Nonce = 0
+		if updateExtraNonce == nil {
+			return nil, stats, ErrValidBlockHashNotFound
+		}
+
+		stats.ExtraNonce++
+		log.Debugf("Nonce space exhausted, rolling extra nonce: extraNonce=%d", stats.ExtraNonce)
+		err = updateExtraNonce(msgBlock, stats.ExtraNonce)
+		if err != nil {
+			return nil, stats, err
+		}
+	}
+}
+
+// searchNonces searches the nonces from header.Nonce up to math.MaxUint32
+// for a hash that meets target.  The nonces are handed out in batches to
+// the workers; a window of one batch per worker is searched at a time and
+// the valid nonce from the earliest batch in the window is returned.
+func searchNonces(ctx context.Context, header *btcwire.BlockHeader, target *big.Int, workers int, deterministic bool, stats *SolveStats) (uint32, bool, error) {
+	const endNonce = uint64(math.MaxUint32) + 1
+
+	found := make([]int64, workers)
+	errs := make([]error, workers)
+	for windowStart := uint64(header.Nonce); windowStart < endNonce; windowStart += uint64(workers) * solverBatchSize {
+		select {
+		case <-ctx.Done():
+			return 0, false, ctx.Err()
+		default:
+		}
+
+		var stop int32
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			found[w] = -1
+			batchStart := windowStart + uint64(w)*solverBatchSize
+			if batchStart >= endNonce {
+				continue
+			}
+			batchEnd := batchStart + solverBatchSize
+			if batchEnd > endNonce {
+				batchEnd = endNonce
+			}
+
+			wg.Add(1)
+			go func(w int, batchStart, batchEnd uint64) {
+				defer wg.Done()
+
+				workerHeader := *header
+				var hashes uint64
+				defer func() {
+					atomic.AddUint64(&stats.Hashes, hashes)
+				}()
+
+				for nonce := batchStart; nonce < batchEnd; nonce++ {
+					if !deterministic && atomic.LoadInt32(&stop) != 0 {
+						return
+					}
+
+					workerHeader.Nonce = uint32(nonce)
+					hash, err := workerHeader.BlockSha()
+					if err != nil {
+						errs[w] = err
+						atomic.StoreInt32(&stop, 1)
+						return
+					}
+					hashes++
+
+					if btcchain.ShaHashToBig(&hash).Cmp(target) <= 0 {
+						found[w] = int64(nonce)
+						atomic.StoreInt32(&stop, 1)
+						return
+					}
+				}
+			}(w, batchStart, batchEnd)
+		}
+		wg.Wait()
+
+		for w := 0; w < workers; w++ {
+			if errs[w] != nil {
+				return 0, false, errs[w]
+			}
+			if found[w] >= 0 {
+				return uint32(found[w]), true, nil
+			}
+		}
+	}
+
+	return 0, false, nil
+}
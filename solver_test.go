@@ -0,0 +1,74 @@
+package regtester
+
+import (
+	"context"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+	"time"
+)
+
+// newTestSolverBlock returns an unsolved block at the minimum difficulty
+// that differs by merkleRoot.
+func newTestSolverBlock(merkleRoot byte) *btcutil.Block {
+	header := btcwire.BlockHeader{
+		Version:   2,
+		Timestamp: time.Unix(1400000000, 0),
+		Bits:      0x207fffff,
+	}
+	header.MerkleRoot[0] = merkleRoot
+	block := btcutil.NewBlock(btcwire.NewMsgBlock(&header))
+	block.SetHeight(1)
+	return block
+}
+
+func TestSolveBlockDeterministic(t *testing.T) {
+	for merkleRoot := byte(0); merkleRoot < 4; merkleRoot++ {
+		serialBlock, serialStats, err := solveBlock(context.Background(),
+			newTestSolverBlock(merkleRoot), nil, &SolverOptions{Workers: 1})
+		if err != nil {
+			t.Errorf("block %d: serial solve failed: %v", merkleRoot, err)
+			continue
+		}
+		serialHeader := serialBlock.MsgBlock().Header
+		serialSha, _ := serialHeader.BlockSha()
+		if btcchain.ShaHashToBig(&serialSha).Cmp(bitcoindMinTarget) > 0 {
+			t.Errorf("block %d: hash %v doesn't meet the target", merkleRoot, serialSha)
+		}
+		if serialStats.Hashes != uint64(serialHeader.Nonce)+1 {
+			t.Errorf("block %d: serial solve took %d hashes for nonce %d",
+				merkleRoot, serialStats.Hashes, serialHeader.Nonce)
+		}
+
+		opts := &SolverOptions{Workers: 4, Deterministic: true}
+		parallelBlock, parallelStats, err := solveBlock(context.Background(),
+			newTestSolverBlock(merkleRoot), nil, opts)
+		if err != nil {
+			t.Errorf("block %d: parallel solve failed: %v", merkleRoot, err)
+			continue
+		}
+		parallelNonce := parallelBlock.MsgBlock().Header.Nonce
+		if parallelNonce != serialHeader.Nonce {
+			t.Errorf("block %d: got nonce %d with 4 workers, want %d",
+				merkleRoot, parallelNonce, serialHeader.Nonce)
+		}
+		if parallelStats.Hashes < serialStats.Hashes {
+			t.Errorf("block %d: got %d hashes with 4 workers, want at least %d",
+				merkleRoot, parallelStats.Hashes, serialStats.Hashes)
+		}
+	}
+}
+
+func TestSolveBlockCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, workers := range []int{1, 4} {
+		opts := &SolverOptions{Workers: workers}
+		_, _, err := solveBlock(ctx, newTestSolverBlock(0), nil, opts)
+		if err != ctx.Err() {
+			t.Errorf("%d workers: got error %v, want %v", workers, err, ctx.Err())
+		}
+	}
+}
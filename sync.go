@@ -5,66 +5,388 @@ import (
 	"errors"
 	"github.com/conformal/btcchain"
 	"github.com/conformal/btcdb"
+	_ "github.com/conformal/btcdb/ldb"
 	_ "github.com/conformal/btcdb/memdb"
 	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
 	"github.com/flammit/btcdcommander"
+	"os"
+	"time"
 )
 
 var (
-	ErrNoTxInfo = errors.New("couldn't find tx")
+	ErrNoTxInfo         = errors.New("couldn't find tx")
+	ErrNoCommonAncestor = errors.New("db has no blocks in common with btcd")
+	ErrGenesisMismatch  = errors.New("db genesis block doesn't match the network of btcd")
+	ErrNoDbPath         = errors.New("persistent db needs a path")
 )
 
+// defaultSyncWindow is the number of blocks downloaded concurrently when
+// SyncOptions.Window isn't set.
+const defaultSyncWindow = 32
+
+// syncProgressInterval is how often sync progress is logged.
+const syncProgressInterval = 5 * time.Second
+
+// defaultDbType is the btcdb backend used when SyncOptions.DbType isn't
+// set.
+const defaultDbType = "memdb"
+
+// SyncOptions controls how blocks are downloaded from btcd and where
+// they're stored.
+type SyncOptions struct {
+	// Window is the most blocks downloaded concurrently.
+	Window int
+
+	// Progress is called after each block is processed.
+	Progress func(height, endHeight int64)
+
+	// DbType is the btcdb backend, such as "leveldb".  It defaults to
+	// "memdb".
+	DbType string
+
+	// DbPath is the path of a persistent database and is required for
+	// any DbType but "memdb".  An existing database is checked against
+	// btcd and resynced instead of being recreated.
+	DbPath string
+}
+
+func (opts *SyncOptions) dbType() string {
+	if opts == nil || opts.DbType == "" {
+		return defaultDbType
+	}
+	return opts.DbType
+}
+
+func (opts *SyncOptions) window() int {
+	if opts == nil || opts.Window <= 0 {
+		return defaultSyncWindow
+	}
+	return opts.Window
+}
+
+// createDB creates a new database of dbType, stored at dbPath unless it's
+// a memdb.
+func createDB(dbType, dbPath string) (btcdb.Db, error) {
+	if dbType == defaultDbType {
+		return btcdb.CreateDB(dbType)
+	}
+	return btcdb.CreateDB(dbType, dbPath)
+}
+
+// openDB opens the existing database of dbType at dbPath and checks that
+// it holds the chain of btcd by comparing the genesis block.  Blocks that
+// btcd no longer has are dropped by ResyncChain.
+func openDB(btcd *btcdcommander.Commander, dbType, dbPath string, genesisHash *btcwire.ShaHash) (btcdb.Db, error) {
+	db, err := btcdb.OpenDB(dbType, dbPath)
+	if err != nil {
+		log.Errorf("Failed to open db: type=%s, path=%s, error=%v", dbType, dbPath, err)
+		return nil, err
+	}
+
+	sha, err := db.FetchBlockShaByHeight(0)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !sha.IsEqual(genesisHash) {
+		db.Close()
+		log.Errorf("Db genesis block doesn't match network: path=%s, sha=%v, net=%v", dbPath, sha, btcd.Cfg.Net())
+		return nil, ErrGenesisMismatch
+	}
+
+	_, height, err := db.NewestSha()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	log.Infof("Opened existing db: type=%s, path=%s, height=%d", dbType, dbPath, height)
+	return db, nil
+}
+
 // SyncChain puts the pulls the full blockchain from btcd
-// and places it in a memdb instance of the BlockChain
+// and places it in a memdb instance of the BlockChain.  The genesis block
+// comes from the mining params registered for the network of btcd.
 func SyncChain(btcd *btcdcommander.Commander) (*btcchain.BlockChain, btcdb.Db, error) {
+	return SyncChainWithOptions(btcd, nil)
+}
+
+// SyncChainWithOptions is like SyncChain but downloads blocks as specified
+// by opts and can store them in a persistent database, which the caller
+// should Close when done.
+func SyncChainWithOptions(btcd *btcdcommander.Commander, opts *SyncOptions) (*btcchain.BlockChain, btcdb.Db, error) {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+
 	net := btcd.Cfg.Net()
-	chainParams := btcchain.ChainParams(net)
+	miningParams, err := ChainMiningParams(net)
+	if err != nil {
+		log.Errorf("Failed to find mining params: net=%v, error=%v", net, err)
+		return nil, nil, err
+	}
+	chainParams := miningParams.ChainParams
+
+	dbType := opts.dbType()
+	if dbType != defaultDbType {
+		if opts.DbPath == "" {
+			return nil, nil, ErrNoDbPath
+		}
 
-	db, err := btcdb.CreateDB("memdb")
+		_, err := os.Stat(opts.DbPath)
+		if err == nil {
+			db, err := openDB(btcd, dbType, opts.DbPath, chainParams.GenesisHash)
+			if err != nil {
+				return nil, nil, err
+			}
+			chain, err := ResyncChainWithOptions(btcd, db, opts)
+			if err != nil {
+				db.Close()
+				return nil, nil, err
+			}
+			return chain, db, nil
+		}
+		if !os.IsNotExist(err) {
+			log.Errorf("Failed to check for existing db: path=%s, error=%v", opts.DbPath, err)
+			return nil, nil, err
+		}
+	}
+
+	db, err := createDB(dbType, opts.DbPath)
+	if err != nil {
+		log.Errorf("Failed to make new db: type=%s, path=%s, error=%v", dbType, opts.DbPath, err)
+		return nil, nil, err
+	}
+	chain, err := syncNewDB(btcd, db, chainParams, opts)
 	if err != nil {
-		log.Errorf("Failed to make new memdb: error=%v", err)
+		db.Close()
 		return nil, nil, err
 	}
+
+	return chain, db, nil
+}
+
+// syncNewDB adds the genesis block to the newly created db and then every
+// block in the main chain of btcd.
+func syncNewDB(btcd *btcdcommander.Commander, db btcdb.Db, chainParams *btcchain.Params, opts *SyncOptions) (*btcchain.BlockChain, error) {
 	genesisBlock := btcutil.NewBlock(chainParams.GenesisBlock)
 	genesisBlock.SetHeight(0)
-	db.InsertBlock(genesisBlock)
+	_, err := db.InsertBlock(genesisBlock)
+	if err != nil {
+		log.Errorf("Failed to insert genesis block: error=%v", err)
+		return nil, err
+	}
 
-	chain := btcchain.New(db, net, nil)
+	chain := btcchain.New(db, btcd.Cfg.Net(), nil)
 
 	bestBlockInfo, jsonErr := btcd.GetBestBlock()
 	if jsonErr != nil {
-		return nil, nil, errors.New(jsonErr.Message)
+		return nil, errors.New(jsonErr.Message)
 	}
 
-	for height := int64(1); height <= int64(bestBlockInfo.Height); height++ {
-		blockHash, jsonErr := btcd.GetBlockHash(height)
-		if jsonErr != nil {
-			return nil, nil, errors.New(jsonErr.Message)
+	err = syncBlocks(chain, db, btcd, 1, int64(bestBlockInfo.Height), opts)
+	if err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// ResyncChain brings db up to date with the main chain of btcd.  It finds
+// the newest block db has in common with btcd, drops any blocks after it
+// and fetches only the blocks btcd has beyond that point.  Any BlockChain
+// previously created over db is stale afterwards, so the returned one
+// must be used instead.
+func ResyncChain(btcd *btcdcommander.Commander, db btcdb.Db) (*btcchain.BlockChain, error) {
+	return ResyncChainWithOptions(btcd, db, nil)
+}
+
+// ResyncChainWithOptions is like ResyncChain but downloads blocks as
+// specified by opts.
+func ResyncChainWithOptions(btcd *btcdcommander.Commander, db btcdb.Db, opts *SyncOptions) (*btcchain.BlockChain, error) {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+
+	bestBlockInfo, jsonErr := btcd.GetBestBlock()
+	if jsonErr != nil {
+		return nil, errors.New(jsonErr.Message)
+	}
+	bestHeight := int64(bestBlockInfo.Height)
+
+	forkSha, forkHeight, err := findForkPoint(btcd, db, bestHeight)
+	if err != nil {
+		log.Errorf("Failed to find fork point with btcd: error=%v", err)
+		return nil, err
+	}
+
+	_, newestHeight, err := db.NewestSha()
+	if err != nil {
+		return nil, err
+	}
+	if forkHeight < newestHeight {
+		log.Infof("Rewinding chain: height=%d, forkHeight=%d, forkSha=%v", newestHeight, forkHeight, forkSha)
+		err = db.DropAfterBlockBySha(forkSha)
+		if err != nil {
+			log.Errorf("Failed to rewind chain: error=%v", err)
+			return nil, err
 		}
+	}
 
-		blockHex, jsonErr := btcd.GetRawBlock(blockHash)
+	chain := btcchain.New(db, btcd.Cfg.Net(), nil)
+	err = syncBlocks(chain, db, btcd, forkHeight+1, bestHeight, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return chain, nil
+}
+
+// findForkPoint returns the newest block in db that is also in the main
+// chain of btcd, which is no higher than bestHeight.
+func findForkPoint(btcd *btcdcommander.Commander, db btcdb.Db, bestHeight int64) (*btcwire.ShaHash, int64, error) {
+	_, height, err := db.NewestSha()
+	if err != nil {
+		return nil, 0, err
+	}
+	if height > bestHeight {
+		height = bestHeight
+	}
+
+	for ; height >= 0; height-- {
+		sha, err := db.FetchBlockShaByHeight(height)
+		if err != nil {
+			return nil, 0, err
+		}
+		blockHash, jsonErr := btcd.GetBlockHash(height)
 		if jsonErr != nil {
-			return nil, nil, errors.New(jsonErr.Message)
+			return nil, 0, errors.New(jsonErr.Message)
+		}
+		if sha.String() == blockHash {
+			return sha, height, nil
 		}
+	}
 
-		blockBytes, err := hex.DecodeString(blockHex)
-		if err != nil {
-			return nil, nil, err
+	return nil, 0, ErrNoCommonAncestor
+}
+
+// syncBlocks fetches the blocks from startHeight to endHeight in the main
+// chain of btcd and processes them in chain.  Up to opts.Window blocks are
+// downloaded concurrently while they're processed in order.
+func syncBlocks(chain *btcchain.BlockChain, db btcdb.Db, btcd *btcdcommander.Commander, startHeight, endHeight int64, opts *SyncOptions) error {
+	if startHeight > endHeight {
+		return nil
+	}
+
+	quit := make(chan struct{})
+	defer close(quit)
+	// the block being processed holds one slot of the window
+	pending := make(chan chan blockResult, opts.window()-1)
+	go func() {
+		defer close(pending)
+		for height := startHeight; height <= endHeight; height++ {
+			result := make(chan blockResult, 1)
+			select {
+			case pending <- result:
+			case <-quit:
+				return
+			}
+
+			go func(height int64) {
+				block, err := downloadBlock(btcd, height)
+				result <- blockResult{block, err}
+			}(height)
 		}
+	}()
 
-		block, err := btcutil.NewBlockFromBytes(blockBytes)
-		if err != nil {
-			return nil, nil, err
+	progress := newSyncProgress(startHeight, endHeight, opts.Progress)
+	for result := range pending {
+		r := <-result
+		if r.err != nil {
+			log.Errorf("Failed to download block: error=%v", r.err)
+			return r.err
 		}
-		block.SetHeight(height)
 
-		err = chain.ProcessBlock(block, false)
+		err := addBlock(btcd.Cfg.Net(), chain, db, r.block)
 		if err != nil {
-			return nil, nil, err
+			return err
 		}
+		progress.blockProcessed(r.block.Height())
 	}
+	return nil
+}
 
-	return chain, db, nil
+// blockResult is a downloaded block or the error downloading it.
+type blockResult struct {
+	block *btcutil.Block
+	err   error
+}
+
+// syncProgress logs the progress of syncBlocks and reports it to an
+// optional callback.
+type syncProgress struct {
+	startHeight int64
+	endHeight   int64
+	startTime   time.Time
+	lastLog     time.Time
+	callback    func(height, endHeight int64)
+}
+
+func newSyncProgress(startHeight, endHeight int64, callback func(height, endHeight int64)) *syncProgress {
+	now := time.Now()
+	return &syncProgress{
+		startHeight: startHeight,
+		endHeight:   endHeight,
+		startTime:   now,
+		lastLog:     now,
+		callback:    callback,
+	}
+}
+
+func (p *syncProgress) blockProcessed(height int64) {
+	if p.callback != nil {
+		p.callback(height, p.endHeight)
+	}
+
+	now := time.Now()
+	if height != p.endHeight && now.Sub(p.lastLog) < syncProgressInterval {
+		return
+	}
+	p.lastLog = now
+
+	blocks := height - p.startHeight + 1
+	elapsed := now.Sub(p.startTime)
+	log.Infof("Synced blocks: height=%d, endHeight=%d, blocks=%d, elapsed=%v, blocksPerSec=%.1f",
+		height, p.endHeight, blocks, elapsed, float64(blocks)/elapsed.Seconds())
+}
+
+// downloadBlock returns the block at height in the main chain of btcd.
+func downloadBlock(btcd *btcdcommander.Commander, height int64) (*btcutil.Block, error) {
+	blockHash, jsonErr := btcd.GetBlockHash(height)
+	if jsonErr != nil {
+		return nil, errors.New(jsonErr.Message)
+	}
+	return downloadBlockByHash(btcd, blockHash, height)
+}
+
+// downloadBlockByHash returns the block with blockHash from btcd with its
+// height set.
+func downloadBlockByHash(btcd *btcdcommander.Commander, blockHash string, height int64) (*btcutil.Block, error) {
+	blockHex, jsonErr := btcd.GetRawBlock(blockHash)
+	if jsonErr != nil {
+		return nil, errors.New(jsonErr.Message)
+	}
+
+	blockBytes, err := hex.DecodeString(blockHex)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := btcutil.NewBlockFromBytes(blockBytes)
+	if err != nil {
+		return nil, err
+	}
+	block.SetHeight(height)
+	return block, nil
 }
 
 // RetrieveCurrentMempoolTxs returns all the transactions currently in the
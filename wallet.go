@@ -0,0 +1,381 @@
+package regtester
+
+import (
+	"errors"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/flammit/btcdcommander"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrNoWalletKeys     = errors.New("wallet needs at least one key")
+	ErrBlockNotConnects = errors.New("block doesn't connect to the wallet tip")
+)
+
+// Utxo is an unspent output that can be signed for by a wallet key.
+type Utxo struct {
+	Tx       *btcutil.Tx
+	Index    uint32
+	Value    int64
+	Height   int64
+	Coinbase bool
+	PkWif    string
+}
+
+// TxInDetails returns the details needed to spend the output with
+// SendTransaction.
+func (u *Utxo) TxInDetails() *TxInDetails {
+	return &TxInDetails{
+		Tx:    u.Tx,
+		Index: u.Index,
+		PkWif: u.PkWif,
+	}
+}
+
+// walletBlock records the changes a connected block made to the wallet so
+// they can be undone when the block is disconnected.
+type walletBlock struct {
+	sha     btcwire.ShaHash
+	height  int64
+	created []btcwire.OutPoint
+	spent   []*Utxo
+}
+
+// Wallet owns a set of keys and tracks the outputs they can spend as
+// blocks are connected.  A wallet added to a Follower is rescanned whenever
+// the follower's tip changes.  The ExtendChain functions don't update
+// wallets, so a wallet that isn't added to a Follower only sees blocks
+// passed to ConnectBlock and stays stale until Rescan is called.
+type Wallet struct {
+	mtx sync.Mutex
+
+	// FeePerKb is the fee rate in satoshi per 1000 bytes paid by Send.
+	FeePerKb int64
+
+	net           btcwire.BitcoinNet
+	btcd          *btcdcommander.Commander
+	miningParams  *MiningParams
+	keys          keyring
+	changeAddress btcutil.Address
+
+	utxos   map[btcwire.OutPoint]*Utxo
+	pending map[btcwire.OutPoint]btcwire.ShaHash
+	blocks  []*walletBlock
+}
+
+// NewWallet creates a wallet for the keys encoded in pkWifs.  Change is
+// sent to the address of the first key.
+func NewWallet(net btcwire.BitcoinNet, btcd *btcdcommander.Commander, pkWifs ...string) (*Wallet, error) {
+	if len(pkWifs) == 0 {
+		return nil, ErrNoWalletKeys
+	}
+	miningParams, err := ChainMiningParams(net)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := newKeyring(net, pkWifs)
+	if err != nil {
+		return nil, err
+	}
+	changeAddress, err := AddressFromWif(net, pkWifs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Wallet{
+		FeePerKb:      DefaultFeePerKb,
+		net:           net,
+		btcd:          btcd,
+		miningParams:  miningParams,
+		keys:          keys,
+		changeAddress: changeAddress,
+		utxos:         make(map[btcwire.OutPoint]*Utxo),
+		pending:       make(map[btcwire.OutPoint]btcwire.ShaHash),
+		blocks:        make([]*walletBlock, 0),
+	}, nil
+}
+
+// tip returns the last connected block, or nil if there is none.
+func (w *Wallet) tip() *walletBlock {
+	if len(w.blocks) == 0 {
+		return nil
+	}
+	return w.blocks[len(w.blocks)-1]
+}
+
+// Height returns the height of the last connected block, or -1.
+func (w *Wallet) Height() int64 {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	tip := w.tip()
+	if tip == nil {
+		return -1
+	}
+	return tip.height
+}
+
+// ConnectBlock adds the outputs of block paying to wallet keys and removes
+// the outputs it spends.  The block must extend the last connected block.
+func (w *Wallet) ConnectBlock(block *btcutil.Block) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	return w.connectBlock(block)
+}
+
+func (w *Wallet) connectBlock(block *btcutil.Block) error {
+	blockSha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	if tip := w.tip(); tip != nil && !tip.sha.IsEqual(&block.MsgBlock().Header.PrevBlock) {
+		return ErrBlockNotConnects
+	}
+
+	wb := &walletBlock{
+		sha:    *blockSha,
+		height: block.Height(),
+	}
+	for txIndex, tx := range block.Transactions() {
+		mtx := tx.MsgTx()
+		if txIndex > 0 {
+			for _, txIn := range mtx.TxIn {
+				utxo, ok := w.utxos[txIn.PreviousOutpoint]
+				if !ok {
+					continue
+				}
+				delete(w.utxos, txIn.PreviousOutpoint)
+				delete(w.pending, txIn.PreviousOutpoint)
+				wb.spent = append(wb.spent, utxo)
+			}
+		}
+
+		for i, txOut := range mtx.TxOut {
+			pkWif, ok := w.keys.wif(txOut.PkScript)
+			if !ok {
+				continue
+			}
+			outPoint := btcwire.OutPoint{*tx.Sha(), uint32(i)}
+			w.utxos[outPoint] = &Utxo{
+				Tx:       tx,
+				Index:    uint32(i),
+				Value:    txOut.Value,
+				Height:   block.Height(),
+				Coinbase: txIndex == 0,
+				PkWif:    pkWif,
+			}
+			wb.created = append(wb.created, outPoint)
+		}
+	}
+
+	w.blocks = append(w.blocks, wb)
+	return nil
+}
+
+// DisconnectBlock undoes the last connected block.
+func (w *Wallet) DisconnectBlock() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.disconnectBlock()
+	return w.refreshPending()
+}
+
+func (w *Wallet) disconnectBlock() {
+	wb := w.tip()
+	if wb == nil {
+		return
+	}
+
+	for _, outPoint := range wb.created {
+		delete(w.utxos, outPoint)
+	}
+	for _, utxo := range wb.spent {
+		outPoint := btcwire.OutPoint{*utxo.Tx.Sha(), utxo.Index}
+		w.utxos[outPoint] = utxo
+	}
+	w.blocks = w.blocks[:len(w.blocks)-1]
+}
+
+// Rescan brings the wallet up to date with the main chain in db,
+// disconnecting any blocks that are no longer part of it.
+func (w *Wallet) Rescan(db btcdb.Db) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	_, newestHeight, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+
+	// rewind to the last block still in the main chain
+	for tip := w.tip(); tip != nil; tip = w.tip() {
+		if tip.height <= newestHeight {
+			sha, err := db.FetchBlockShaByHeight(tip.height)
+			if err != nil {
+				return err
+			}
+			if sha.IsEqual(&tip.sha) {
+				break
+			}
+		}
+		log.Infof("Wallet disconnecting block: height=%d, sha=%v", tip.height, tip.sha)
+		w.disconnectBlock()
+	}
+
+	height := int64(0)
+	if tip := w.tip(); tip != nil {
+		height = tip.height + 1
+	}
+	for ; height <= newestHeight; height++ {
+		sha, err := db.FetchBlockShaByHeight(height)
+		if err != nil {
+			return err
+		}
+		block, err := db.FetchBlockBySha(sha)
+		if err != nil {
+			return err
+		}
+		block.SetHeight(height)
+
+		err = w.connectBlock(block)
+		if err != nil {
+			return err
+		}
+	}
+	return w.refreshPending()
+}
+
+// refreshPending makes the outputs spent by transactions sent from the
+// wallet spendable again once btcd no longer has the transactions in its
+// mempool, such as when they were rejected, evicted or conflicted with a
+// mined transaction.
+func (w *Wallet) refreshPending() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+
+	txShas, jsonErr := w.btcd.GetRawMempool()
+	if jsonErr != nil {
+		return errors.New(jsonErr.Message)
+	}
+	mempool := make(map[string]bool, len(txShas))
+	for _, txSha := range txShas {
+		mempool[txSha] = true
+	}
+
+	for outPoint, txSha := range w.pending {
+		if !mempool[txSha.String()] {
+			delete(w.pending, outPoint)
+		}
+	}
+	return nil
+}
+
+// spendable returns whether utxo is mature at the height of the next block
+// and not already spent by a transaction sent from the wallet.
+func (w *Wallet) spendable(utxo *Utxo) bool {
+	if _, ok := w.pending[btcwire.OutPoint{*utxo.Tx.Sha(), utxo.Index}]; ok {
+		return false
+	}
+	return !utxo.Coinbase || w.nextHeight()-utxo.Height >= w.miningParams.CoinbaseMaturity
+}
+
+func (w *Wallet) nextHeight() int64 {
+	tip := w.tip()
+	if tip == nil {
+		return 0
+	}
+	return tip.height + 1
+}
+
+// sortedUtxos returns the outputs accepted by filter, oldest first.
+func (w *Wallet) sortedUtxos(filter func(*Utxo) bool) []*Utxo {
+	utxos := make([]*Utxo, 0, len(w.utxos))
+	for _, utxo := range w.utxos {
+		if filter(utxo) {
+			utxos = append(utxos, utxo)
+		}
+	}
+	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].Height != utxos[j].Height {
+			return utxos[i].Height < utxos[j].Height
+		}
+		return utxos[i].Value > utxos[j].Value
+	})
+	return utxos
+}
+
+// ListUnspent returns the outputs that can be spent in the next block,
+// oldest first.
+func (w *Wallet) ListUnspent() []*Utxo {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	return w.sortedUtxos(w.spendable)
+}
+
+// ListImmature returns the coinbase outputs that haven't matured yet.
+func (w *Wallet) ListImmature() []*Utxo {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	return w.sortedUtxos(func(utxo *Utxo) bool {
+		return utxo.Coinbase && w.nextHeight()-utxo.Height < w.miningParams.CoinbaseMaturity
+	})
+}
+
+// Balance returns the total value of the outputs that can be spent in the
+// next block.
+func (w *Wallet) Balance() int64 {
+	var balance int64
+	for _, utxo := range w.ListUnspent() {
+		balance += utxo.Value
+	}
+	return balance
+}
+
+// ImmatureBalance returns the total value of the immature coinbase outputs.
+func (w *Wallet) ImmatureBalance() int64 {
+	var balance int64
+	for _, utxo := range w.ListImmature() {
+		balance += utxo.Value
+	}
+	return balance
+}
+
+// Send pays amount to address from the spendable outputs of the wallet,
+// oldest first, paying a fee at FeePerKb and sending any change back to the
+// first wallet key.  The spent outputs aren't used again unless the
+// transaction leaves the mempool of btcd without being mined.
+func (w *Wallet) Send(address string, amount int64) (*btcutil.Tx, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	utxos := w.sortedUtxos(w.spendable)
+	candidates := make([]*TxInDetails, len(utxos))
+	for i, utxo := range utxos {
+		candidates[i] = utxo.TxInDetails()
+	}
+
+	txOut, err := PubKeyHashTxOut(address, amount)
+	if err != nil {
+		return nil, err
+	}
+	txOuts := []*btcwire.TxOut{txOut}
+
+	sentTx, err := SendPayment(w.net, candidates, txOuts, w.changeAddress.EncodeAddress(), w.FeePerKb, w.btcd)
+	if err != nil {
+		log.Errorf("Failed to send from wallet: error=%v", err)
+		return nil, err
+	}
+	for _, txIn := range sentTx.MsgTx().TxIn {
+		w.pending[txIn.PreviousOutpoint] = *sentTx.Sha()
+	}
+	log.Infof("Tx sha: %s", sentTx.Sha().String())
+	return sentTx, nil
+}